@@ -1,6 +1,7 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -121,6 +122,47 @@ func (c *Client) HttpRequest(ctx context.Context, method, resolver, path string,
 
 }
 
+// PostJSON sends body as JSON to path on the server of resolver and decodes the JSON response.
+func (c *Client) PostJSON(ctx context.Context, resolver, path string, body any, response any) error {
+
+	domain, err := c.resolveResolver(ctx, resolver)
+	if err != nil {
+		return fmt.Errorf("failed to resolve resolver: %v", err)
+	}
+	if domain == "" {
+		return fmt.Errorf("resolver cannot be empty")
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %v", err)
+	}
+
+	url := "https://" + domain + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to perform request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(response)
+	if err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	return nil
+}
+
 func (c *Client) HttpRequestText(ctx context.Context, method, resolver, path string) (string, error) {
 
 	if resolver == "" || resolver == c.defaultResolver {
@@ -272,6 +314,12 @@ func (c *Client) GetResource(ctx context.Context, uri string, accept string, opt
 	if !ok {
 		return fmt.Errorf("resource endpoint not found")
 	}
+	if accept == "application/chunkline+json" {
+		// static hosts cannot negotiate the content type and serve manifests separately
+		if manifest, ok := info.Endpoints["net.concrnt.chunkline.manifest"]; ok {
+			endpoint = manifest
+		}
+	}
 
 	template := endpoint.Template
 
@@ -306,3 +354,52 @@ func (c *Client) GetResource(ctx context.Context, uri string, accept string, opt
 
 	return nil
 }
+
+// FetchJSON gets an absolute http(s) URL, such as a policy document, and decodes it into result.
+func (c *Client) FetchJSON(ctx context.Context, url string, result any) error {
+	fmt.Printf("Fetching JSON from URL: %s\n", url)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to perform request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	return nil
+}
+
+// GetResources gets the signed documents at uris from the server at domain in one request, keyed by URI.
+func (c *Client) GetResources(ctx context.Context, domain string, uris []string) (map[string]concrnt.ResourceBatchItem, error) {
+	fmt.Printf("Getting %d resources from: %s\n", len(uris), domain)
+
+	info, err := c.GetServer(ctx, domain, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server %s: %v", domain, err)
+	}
+	endpoint, ok := info.Endpoints["net.concrnt.resources"]
+	if !ok {
+		return nil, fmt.Errorf("server %s does not provide batch resource endpoint", domain)
+	}
+
+	var results map[string]concrnt.ResourceBatchItem
+	err = c.PostJSON(ctx, info.Domain, endpoint.Template, concrnt.ResourceBatchRequest{URIs: uris}, &results)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
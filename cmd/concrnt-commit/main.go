@@ -0,0 +1,105 @@
+// concrnt-commit is the write-on-commit mode of concrnt. It only handles POST /commit and
+// writes the records into the static layout of a bucket or directory, which a file server
+// or CDN serves. It keeps no state of its own and needs neither Postgres nor Redis, so it
+// can run on serverless platforms which forward HTTP requests to a container.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/labstack/echo/v4"
+	echomiddleware "github.com/labstack/echo/v4/middleware"
+
+	"github.com/totegamma/concrnt-playground"
+	"github.com/totegamma/concrnt-playground/internal/domain"
+	"github.com/totegamma/concrnt-playground/internal/infra/config"
+	"github.com/totegamma/concrnt-playground/internal/infra/repository"
+	"github.com/totegamma/concrnt-playground/internal/infra/storage"
+	"github.com/totegamma/concrnt-playground/internal/present/rest"
+	"github.com/totegamma/concrnt-playground/internal/usecase"
+)
+
+var (
+	version      = "unknown"
+	buildMachine = "unknown"
+	buildTime    = "unknown"
+	goVersion    = "unknown"
+)
+
+func main() {
+
+	fmt.Fprint(os.Stderr, concrnt.Banner)
+
+	configPath := os.Getenv("CONCRNT_CONFIG")
+	if configPath == "" {
+		configPath = "/etc/concrnt/config/config.yaml"
+	}
+
+	conf, err := config.Load(configPath)
+	if err != nil {
+		panic("failed to load config: " + err.Error())
+	}
+
+	globalConfig := conf.GlobalConfig()
+
+	log.Printf("Concrnt %s starting in write-on-commit mode...", version)
+	log.Printf("Config loaded! I am: %s @ %s on %s", globalConfig.CCID, globalConfig.FQDN, globalConfig.Layer)
+
+	var store repository.ObjectStore
+	switch {
+	case conf.Server.ExportS3 != nil:
+		store = storage.NewS3(*conf.Server.ExportS3)
+	case conf.Server.ExportDir != "":
+		store = storage.NewDirectory(conf.Server.ExportDir)
+	default:
+		panic("write-on-commit mode needs exportS3 or exportDir")
+	}
+
+	softwareInfo := concrnt.SoftwareInfo{
+		Version:      version,
+		BuildMachine: buildMachine,
+		BuildTime:    buildTime,
+		GoVersion:    goVersion,
+	}
+
+	wellKnown := usecase.StaticWellKnown(globalConfig)
+	wellKnown.SoftwareInfo = softwareInfo
+	body, err := json.Marshal(wellKnown)
+	if err != nil {
+		panic(err)
+	}
+	err = store.Put(context.Background(), domain.StaticWellKnownPath, "application/json", body)
+	if err != nil {
+		panic("failed to write well-known document: " + err.Error())
+	}
+
+	recordRepo := repository.NewObjectRecordRepository(store, repository.ChunklineConfig{
+		ChunkSize: conf.Server.ChunkSize,
+		BodySize:  conf.Server.ChunkBodySize,
+	})
+	recordUC := usecase.NewRecordUsecase(recordRepo, nil)
+
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+
+	e.Use(echomiddleware.Logger())
+	e.Use(echomiddleware.Recover())
+	e.Use(echomiddleware.CORS())
+
+	handler := rest.NewHandler(globalConfig, softwareInfo, recordUC, nil, nil, nil, nil, nil, nil)
+	handler.RegisterCommitRoutes(e)
+
+	// serverless platforms pass the port to listen on
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8000"
+	}
+
+	e.Logger.Fatal(e.Start(":" + port))
+
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/labstack/echo/v4"
 	echomiddleware "github.com/labstack/echo/v4/middleware"
@@ -8,13 +9,16 @@ import (
 	"go.opentelemetry.io/otel/trace"
 	"log"
 	"os"
+	"time"
 
 	"github.com/totegamma/concrnt-playground"
 	"github.com/totegamma/concrnt-playground/client"
 	"github.com/totegamma/concrnt-playground/internal/infra/config"
 	"github.com/totegamma/concrnt-playground/internal/infra/database"
+	"github.com/totegamma/concrnt-playground/internal/infra/election"
 	"github.com/totegamma/concrnt-playground/internal/infra/gateway"
 	"github.com/totegamma/concrnt-playground/internal/infra/repository"
+	"github.com/totegamma/concrnt-playground/internal/infra/storage"
 	"github.com/totegamma/concrnt-playground/internal/present/rest"
 	"github.com/totegamma/concrnt-playground/internal/present/rest/middleware"
 	"github.com/totegamma/concrnt-playground/internal/service"
@@ -102,15 +106,79 @@ func main() {
 	redis := database.NewRedis(conf.Server.RedisAddr, "", conf.Server.RedisDB)
 
 	cl := client.New(conf.Server.GatewayAddr)
-	signal := service.NewSignalService(redis)
+	signal := service.NewSignalService(redis, service.SignalOptions{
+		EventRetention: conf.Server.EventRetention,
+		QueueSize:      conf.Server.SocketQueueSize,
+		OverflowPolicy: service.OverflowPolicy(conf.Server.SocketOverflowPolicy),
+	})
+
+	leaseDuration := conf.Server.LeaseDuration
+	if leaseDuration <= 0 {
+		leaseDuration = 10 * time.Second
+	}
+	var elector service.Elector
+	switch conf.Server.LeaderElection {
+	case "redis":
+		elector = election.New(election.NewRedisLock(redis, election.InstanceID(), leaseDuration), leaseDuration)
+	case "kubernetes":
+		lock, err := election.NewKubernetesLock(election.InstanceID(), leaseDuration)
+		if err != nil {
+			panic(err)
+		}
+		elector = election.New(lock, leaseDuration)
+	default:
+		elector = election.NewLocal()
+	}
+
+	relay := service.NewRelayService(&globalConfig, cl, signal, elector)
+	signal.SetRelay(relay)
+	go relay.Start(context.Background())
 	auth := service.NewAuthService(&globalConfig, cl)
+	policy := service.NewPolicyService(cl)
 
 	recordRepo := repository.NewRecordRepository(db, signal)
-	recordUC := usecase.NewRecordUsecase(recordRepo)
+	recordGateway := gateway.NewRecordGateway(&globalConfig, cl)
+	recordUC := usecase.NewRecordUsecase(recordRepo, recordGateway)
+
+	var searchUC *usecase.SearchUsecase
+	if len(conf.Server.SearchFields) > 0 {
+		searchRepo := repository.NewSearchRepository(db, repository.SearchConfig{
+			Fields: conf.Server.SearchFields,
+		})
+		recordRepo.SetSearch(searchRepo)
+		searchUC = usecase.NewSearchUsecase(searchRepo)
+		go func() {
+			indexed, err := searchRepo.Backfill(context.Background())
+			if err != nil {
+				log.Printf("search backfill failed after %d records: %v", indexed, err)
+				return
+			}
+			log.Printf("search backfill indexed %d records", indexed)
+		}()
+	}
+	realtimeUC := usecase.NewRealtimeUsecase(recordRepo, policy)
 
-	chunklineRepo := repository.NewChunklineRepository(db)
-	chunklineGateway := gateway.NewChunklineGateway(cl)
+	chunklineRepo := repository.NewChunklineRepository(db, mc, repository.ChunklineConfig{
+		ChunkSize: conf.Server.ChunkSize,
+		BodySize:  conf.Server.ChunkBodySize,
+	})
+	chunklineGateway := gateway.NewChunklineGateway(&globalConfig, cl, mc, chunklineRepo)
 	chunklineUC := usecase.NewChunklineUsecase(chunklineRepo, chunklineGateway)
+	signal.OnPublish(chunklineRepo.Invalidate)
+
+	var exportStores []usecase.ExportStore
+	if conf.Server.ExportDir != "" {
+		exportStores = append(exportStores, storage.NewDirectory(conf.Server.ExportDir))
+	}
+	if conf.Server.ExportS3 != nil {
+		exportStores = append(exportStores, storage.NewS3(*conf.Server.ExportS3))
+	}
+	if len(exportStores) > 0 {
+		exportUC := usecase.NewExportUsecase(globalConfig, recordRepo, chunklineRepo, exportStores...)
+		signal.OnPublish(exportUC.OnPublish)
+		go exportUC.Start(context.Background())
+		go elector.Run(context.Background(), "export", exportUC.Bootstrap)
+	}
 
 	serverRepo := repository.NewServerRepository(&globalConfig, db, cl)
 	serverUC := usecase.NewServerUsecase(serverRepo)
@@ -122,7 +190,7 @@ func main() {
 
 	e.Use(authMiddleware.IdentifyIdentity)
 
-	handler := rest.NewHandler(globalConfig, softwareInfo, recordUC, chunklineUC, serverUC, entityUC, signal)
+	handler := rest.NewHandler(globalConfig, softwareInfo, recordUC, chunklineUC, serverUC, entityUC, realtimeUC, searchUC, signal)
 	handler.RegisterRoutes(e)
 
 	e.Logger.Fatal(e.Start(":8000"))
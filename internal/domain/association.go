@@ -0,0 +1,13 @@
+package domain
+
+import (
+	"fmt"
+
+	"github.com/zeebo/xxh3"
+)
+
+// AssociationUnique returns the unique hash of an association. An owner has at most one association
+// per target, schema and variant, so associating again replaces the previous one.
+func AssociationUnique(owner, target, schema, variant string) string {
+	return fmt.Sprintf("%x", xxh3.HashString(owner+"\x00"+target+"\x00"+schema+"\x00"+variant))
+}
@@ -1,5 +1,16 @@
 package domain
 
+import "time"
+
+// ChunkCloseGrace is how long after its end a chunk still counts as open.
+// It allows for clock differences between instances and with remote servers.
+const ChunkCloseGrace = 10 * time.Second
+
+// RemovedItemsRetention is how long a removal stays in the removed items of a collection.
+// Readers must not keep chunk bodies any longer, or removed items come back. Static exports,
+// whose bodies are never rewritten, list every removal instead.
+const RemovedItemsRetention = 7 * 24 * time.Hour
+
 const (
 	RequesterTypeCtxKey      = "cc-requesterType"
 	RequesterIdCtxKey        = "cc-requesterId"
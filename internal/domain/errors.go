@@ -26,3 +26,53 @@ func (e NotFoundError) Is(target error) bool {
 
 // ErrNotFound is the sentinel error for missing resources.
 var ErrNotFound = NotFoundError{}
+
+// ConflictError represents a write lost to a concurrent one.
+type ConflictError struct {
+	Resource string
+}
+
+func (e ConflictError) Error() string {
+	if e.Resource == "" {
+		return "conflict"
+	}
+	return fmt.Sprintf("%s was modified concurrently", e.Resource)
+}
+
+// Is enables errors.Is matching on ConflictError.
+func (e ConflictError) Is(target error) bool {
+	_, ok := target.(ConflictError)
+	if ok {
+		return true
+	}
+	_, ok = target.(*ConflictError)
+	return ok
+}
+
+// ErrConflict is the sentinel error for lost concurrent writes.
+var ErrConflict = ConflictError{}
+
+// ForbiddenError represents a change the requester is not allowed to make.
+type ForbiddenError struct {
+	Reason string
+}
+
+func (e ForbiddenError) Error() string {
+	if e.Reason == "" {
+		return "forbidden"
+	}
+	return fmt.Sprintf("forbidden: %s", e.Reason)
+}
+
+// Is enables errors.Is matching on ForbiddenError.
+func (e ForbiddenError) Is(target error) bool {
+	_, ok := target.(ForbiddenError)
+	if ok {
+		return true
+	}
+	_, ok = target.(*ForbiddenError)
+	return ok
+}
+
+// ErrForbidden is the sentinel error for changes the requester is not allowed to make.
+var ErrForbidden = ForbiddenError{}
@@ -0,0 +1,151 @@
+package domain
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/totegamma/concrnt-playground/policy"
+)
+
+// QueryCursor is the position of the last record of a query page. Records are ordered by
+// creation date and then by document ID, so that records created at the same time are neither
+// skipped nor repeated between pages.
+type QueryCursor struct {
+	CDate      time.Time `json:"t"`
+	DocumentID string    `json:"id"`
+}
+
+// Encode returns the opaque form of the cursor handed to clients.
+func (c QueryCursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// ParseQueryCursor decodes a cursor made by Encode.
+func ParseQueryCursor(s string) (QueryCursor, error) {
+	var cursor QueryCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor, errors.New("invalid cursor")
+	}
+	err = json.Unmarshal(data, &cursor)
+	if err != nil || cursor.DocumentID == "" {
+		return cursor, errors.New("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// maxQueryFilterNodes bounds the size of a query filter expression.
+const maxQueryFilterNodes = 32
+
+// ParseQueryFilter decodes a query filter written in the policy expression syntax and checks that it
+// only uses the subset which can be run against the stored values:
+//
+//   - And, Or and Not of filters
+//   - Eq of a Load of a value field and a scalar Const
+//   - Contains of a Load of an array value field and a scalar Const
+//   - Contains of a Const list of scalars and a Load of a value field
+//
+// Value fields are loaded with paths starting with "value.", such as "value.tags".
+func ParseQueryFilter(s string) (policy.Expr, error) {
+	var expr policy.Expr
+	if err := json.Unmarshal([]byte(s), &expr); err != nil {
+		return expr, errors.New("invalid filter")
+	}
+	nodes := 0
+	if err := validateQueryFilter(expr, &nodes); err != nil {
+		return expr, err
+	}
+	return expr, nil
+}
+
+// QueryFilterPath returns the value field path loaded by a Load expression of a query filter.
+func QueryFilterPath(expr policy.Expr) ([]string, bool) {
+	if expr.Operator != "Load" || len(expr.Args) != 1 {
+		return nil, false
+	}
+	key, ok := expr.Args[0].Const.(string)
+	if !ok {
+		return nil, false
+	}
+	path := strings.Split(key, ".")
+	if len(path) < 2 || path[0] != "value" {
+		return nil, false
+	}
+	for _, field := range path[1:] {
+		if field == "" {
+			return nil, false
+		}
+	}
+	return path[1:], true
+}
+
+// IsQueryFilterScalar reports whether expr is a Const usable as a value in a query filter.
+func IsQueryFilterScalar(expr policy.Expr) bool {
+	switch expr.Const.(type) {
+	case string, float64, bool:
+		return len(expr.Args) == 0
+	}
+	return false
+}
+
+func validateQueryFilter(expr policy.Expr, nodes *int) error {
+	*nodes++
+	if *nodes > maxQueryFilterNodes {
+		return errors.New("filter is too large")
+	}
+
+	switch expr.Operator {
+	case "And", "Or":
+		if len(expr.Args) == 0 {
+			return fmt.Errorf("%s needs at least one argument", expr.Operator)
+		}
+		for _, arg := range expr.Args {
+			if err := validateQueryFilter(arg, nodes); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "Not":
+		if len(expr.Args) != 1 {
+			return errors.New("Not needs one argument")
+		}
+		return validateQueryFilter(expr.Args[0], nodes)
+	case "Eq":
+		if len(expr.Args) == 2 {
+			if _, ok := QueryFilterPath(expr.Args[0]); ok && IsQueryFilterScalar(expr.Args[1]) {
+				return nil
+			}
+		}
+		return errors.New("Eq needs a value field and a scalar")
+	case "Contains":
+		if len(expr.Args) == 2 {
+			if _, ok := QueryFilterPath(expr.Args[0]); ok && IsQueryFilterScalar(expr.Args[1]) {
+				return nil
+			}
+			if _, ok := QueryFilterPath(expr.Args[1]); ok && isQueryFilterList(expr.Args[0]) {
+				return nil
+			}
+		}
+		return errors.New("Contains needs a value field and a scalar, or a list of scalars and a value field")
+	default:
+		return fmt.Errorf("unsupported filter operator: %q", expr.Operator)
+	}
+}
+
+func isQueryFilterList(expr policy.Expr) bool {
+	list, ok := expr.Const.([]any)
+	if !ok || len(list) == 0 || len(list) > maxQueryFilterNodes || len(expr.Args) != 0 {
+		return false
+	}
+	for _, item := range list {
+		if !IsQueryFilterScalar(policy.Expr{Const: item}) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package domain
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Static layout
+//
+// Records and timelines can be served by any file server in this layout:
+//
+//	/.well-known/concrnt
+//	/resource/{ccid}/{key}.json                 signed document of a record
+//	/chunkline/{ccid}/{key}/manifest.json       chunkline manifest of a collection
+//	/chunkline/{ccid}/{key}/removed.json        items removed from the collection
+//	/chunkline/{ccid}/{key}/{chunk}.itr         descending iterator
+//	/chunkline/{ccid}/{key}/{chunk}.body.json   descending body
+//	/chunkline/{ccid}/{key}/items/{hash}.chunk  chunk holding an item, written on commit only
+//
+// File servers cannot negotiate content types, so the well-known document advertises
+// the manifests as net.concrnt.chunkline.manifest. Iterators exist for every chunk from
+// the manifest's FirstChunk to its LastChunk, and readers must not look further.
+// Both the static export and the write-on-commit mode write this layout.
+
+const StaticWellKnownPath = "/.well-known/concrnt"
+
+// StaticResourcePath is the path of the signed document of the record owner/key.
+func StaticResourcePath(owner, key string) (string, error) {
+	err := checkStaticSegments(owner, key)
+	if err != nil {
+		return "", err
+	}
+	return "/resource/" + owner + "/" + key + ".json", nil
+}
+
+// StaticChunklinePath is the directory of the timeline of the collection owner/key.
+func StaticChunklinePath(owner, key string) (string, error) {
+	err := checkStaticSegments(owner, key)
+	if err != nil {
+		return "", err
+	}
+	return "/chunkline/" + owner + "/" + key, nil
+}
+
+// checkStaticSegments rejects owners and keys whose paths would be cleaned into the
+// path of another record, another owner or outside of the layout.
+func checkStaticSegments(owner, key string) error {
+	if owner == "" || strings.Contains(owner, "/") || owner == "." || owner == ".." {
+		return fmt.Errorf("invalid owner for a static path: %q", owner)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("invalid key for a static path: %q", key)
+		}
+	}
+	return nil
+}
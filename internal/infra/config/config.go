@@ -2,11 +2,13 @@ package config
 
 import (
 	"os"
+	"time"
 
 	"github.com/go-yaml/yaml"
 
 	"github.com/totegamma/concrnt-playground"
 	"github.com/totegamma/concrnt-playground/internal/domain"
+	"github.com/totegamma/concrnt-playground/internal/infra/storage"
 )
 
 type Config struct {
@@ -35,6 +37,30 @@ type Server struct {
 	CaptchaSecret   string `yaml:"captchaSecret"`
 	VapidPublicKey  string `yaml:"vapidPublicKey"`
 	VapidPrivateKey string `yaml:"vapidPrivateKey"`
+
+	// EventRetention is how long realtime events are kept for replay.
+	EventRetention time.Duration `yaml:"eventRetention"`
+	// SocketQueueSize is the number of events buffered per realtime connection.
+	SocketQueueSize int `yaml:"socketQueueSize"`
+	// SocketOverflowPolicy is one of drop-oldest, coalesce or disconnect.
+	SocketOverflowPolicy string `yaml:"socketOverflowPolicy"`
+	// ChunkSize is the time span of one timeline chunk. Collections may override it.
+	ChunkSize time.Duration `yaml:"chunkSize"`
+	// ChunkBodySize is the number of items a chunk body returns at least, if available.
+	ChunkBodySize int `yaml:"chunkBodySize"`
+	// LeaderElection is none, redis or kubernetes. Use redis or kubernetes when running multiple instances.
+	LeaderElection string `yaml:"leaderElection"`
+	// LeaseDuration is how long a leadership survives without renewal.
+	LeaseDuration time.Duration `yaml:"leaseDuration"`
+	// ExportDir is a directory kept up to date with a static copy of the records and timelines of this server.
+	// In write-on-commit mode records are written there instead of Postgres.
+	ExportDir string `yaml:"exportDir"`
+	// ExportS3 is a bucket kept up to date with the same static copy. It takes precedence over ExportDir
+	// in write-on-commit mode.
+	ExportS3 *storage.S3Config `yaml:"exportS3"`
+	// SearchFields maps a schema to the value fields indexed for search, e.g. "body" of messages.
+	// The search endpoint is only served when it is set.
+	SearchFields map[string][]string `yaml:"searchFields"`
 }
 
 func Load(path string) (Config, error) {
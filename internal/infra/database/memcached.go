@@ -1,9 +1,35 @@
 package database
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/bradfitz/gomemcache/memcache"
 )
 
 func NewMemcached(server string) *memcache.Client {
 	return memcache.New(server)
 }
+
+// GetJSON decodes the cached value of key into value. It reports whether the key was found.
+// Cache failures are treated as misses.
+func GetJSON(mc *memcache.Client, key string, value any) bool {
+	item, err := mc.Get(key)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(item.Value, value) == nil
+}
+
+// SetJSON caches value under key. An expiration of zero keeps it until it is evicted.
+func SetJSON(mc *memcache.Client, key string, value any, expiration time.Duration) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	mc.Set(&memcache.Item{
+		Key:        key,
+		Value:      data,
+		Expiration: int32(expiration / time.Second),
+	})
+}
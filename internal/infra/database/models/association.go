@@ -4,16 +4,33 @@ import (
 	"time"
 )
 
+// Association is a document attached to a record, such as a reaction or a reply.
+// Unique allows one association per owner, target, schema and variant.
+// Associations on records of other servers are the author's copies and have no TargetID.
 type Association struct {
-	TargetID int64     `json:"targetID" gorm:"type:text"`
-	Target   RecordKey `json:"-" gorm:"foreignKey:TargetID;references:ID;constraint:OnDelete:CASCADE;"`
+	TargetID  *int64    `json:"targetID" gorm:"type:bigint;index:idx_associations_target,priority:1"`
+	Target    RecordKey `json:"-" gorm:"foreignKey:TargetID;references:ID;constraint:OnDelete:CASCADE;"`
+	TargetURI string    `json:"targetURI" gorm:"type:text;not null;default:'';index"`
 
 	DocumentID string    `json:"id" gorm:"primaryKey;type:text"`
 	Document   CommitLog `json:"-" gorm:"foreignKey:DocumentID;references:ID;constraint:OnDelete:CASCADE;"`
 	Unique     string    `json:"unique" gorm:"type:text;unique"`
 
-	Owner  string    `json:"owner" gorm:"type:text"`
-	Schema string    `json:"schema" gorm:"type:text"`
-	Value  string    `json:"value" gorm:"type:jsonb"`
-	CDate  time.Time `json:"cdate" gorm:"->;<-:create;type:timestamp with time zone;not null;default:clock_timestamp()"`
+	Author  string    `json:"author" gorm:"type:text;not null;default:'';index"`
+	Owner   string    `json:"owner" gorm:"type:text"`
+	Schema  string    `json:"schema" gorm:"type:text;not null;default:'';index:idx_associations_target,priority:2"`
+	Variant string    `json:"variant" gorm:"type:text;not null;default:'';index:idx_associations_target,priority:3"`
+	Value   string    `json:"value" gorm:"type:jsonb"`
+	CDate   time.Time `json:"cdate" gorm:"->;<-:create;type:timestamp with time zone;not null;default:clock_timestamp()"`
+}
+
+// AssociationCounter is the number of associations of a schema and variant on a record, kept up to date
+// as associations come and go. FirstCDate is the creation date of the oldest of them.
+type AssociationCounter struct {
+	TargetID   int64     `json:"targetID" gorm:"primaryKey;type:bigint"`
+	Target     RecordKey `json:"-" gorm:"foreignKey:TargetID;references:ID;constraint:OnDelete:CASCADE;"`
+	Schema     string    `json:"schema" gorm:"primaryKey;type:text"`
+	Variant    string    `json:"variant" gorm:"primaryKey;type:text"`
+	Count      int64     `json:"count" gorm:"type:bigint;not null"`
+	FirstCDate time.Time `json:"firstCDate" gorm:"type:timestamp with time zone;not null"`
 }
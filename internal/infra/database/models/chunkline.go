@@ -0,0 +1,12 @@
+package models
+
+import (
+	"time"
+)
+
+// RemovedItem is an item removed from a collection, kept so that timeline readers can drop it.
+type RemovedItem struct {
+	CollectionURI string    `json:"collectionURI" gorm:"type:text;primaryKey;index:idx_removed_items_recent,priority:1"`
+	ItemID        string    `json:"itemID" gorm:"type:text;primaryKey"`
+	CDate         time.Time `json:"cdate" gorm:"->;<-:create;type:timestamp with time zone;not null;default:clock_timestamp();index:idx_removed_items_recent,priority:2"`
+}
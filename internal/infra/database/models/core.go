@@ -32,5 +32,6 @@ type Record struct {
 	Document   CommitLog `json:"documnet" gorm:"foreignKey:DocumentID;references:ID;constraint:OnDelete:CASCADE;"`
 	Owner      string    `json:"owner" gorm:"type:text"`
 	Schema     string    `json:"schema" gorm:"type:text"`
+	Value      string    `json:"value" gorm:"type:jsonb;index:idx_records_value,type:gin"`
 	CDate      time.Time `json:"cdate" gorm:"->;<-:create;type:timestamp with time zone;not null;default:clock_timestamp()"`
 }
@@ -0,0 +1,11 @@
+package models
+
+// SearchEntry is the searchable text of a record. It goes away with the record, so that
+// overwritten and deleted records are no longer found. Fields are the configured fields the
+// text was taken from, so that records are reindexed when the configuration changes.
+type SearchEntry struct {
+	DocumentID string `json:"id" gorm:"primaryKey;type:text"`
+	Record     Record `json:"-" gorm:"foreignKey:DocumentID;references:DocumentID;constraint:OnDelete:CASCADE;"`
+	Text       string `json:"text" gorm:"type:text;not null"`
+	Fields     string `json:"fields" gorm:"type:text;not null;default:''"`
+}
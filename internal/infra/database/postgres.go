@@ -1,6 +1,7 @@
 package database
 
 import (
+	"encoding/json"
 	"log"
 	"os"
 	"time"
@@ -9,6 +10,8 @@ import (
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 
+	"github.com/totegamma/concrnt-playground"
+	"github.com/totegamma/concrnt-playground/internal/domain"
 	"github.com/totegamma/concrnt-playground/internal/infra/database/models"
 )
 
@@ -31,14 +34,151 @@ func NewPostgres(dsn string) (*gorm.DB, error) {
 }
 
 func MigratePostgres(db *gorm.DB) error {
-	return db.AutoMigrate(
+	// associations used to store the whole document in value and the target as text
+	legacyAssociations := db.Migrator().HasTable(&models.Association{}) &&
+		!db.Migrator().HasColumn(&models.Association{}, "Variant")
+	if legacyAssociations {
+		err := db.Exec("ALTER TABLE associations ALTER COLUMN target_id TYPE bigint USING target_id::bigint").Error
+		if err != nil {
+			return err
+		}
+	}
+
+	countersMissing := !db.Migrator().HasTable(&models.AssociationCounter{})
+
+	err := db.AutoMigrate(
 		&models.CommitLog{},
 		&models.CommitOwner{},
 		&models.Record{},
 		&models.RecordKey{},
 		&models.Association{},
+		&models.RemovedItem{},
 		&models.Server{},
 		&models.Entity{},
 		&models.EntityMeta{},
+		&models.SearchEntry{},
+		&models.AssociationCounter{},
 	)
+	if err != nil {
+		return err
+	}
+
+	// records made before the value column was added get their value from the commit
+	err = db.Exec(
+		"UPDATE records SET value = (commit_logs.document::jsonb)->'value' " +
+			"FROM commit_logs WHERE commit_logs.id = records.document_id AND records.value IS NULL",
+	).Error
+	if err != nil {
+		return err
+	}
+
+	// references are looked up by href when their target is removed
+	err = db.Exec("CREATE INDEX IF NOT EXISTS idx_records_href ON records ((value->>'href'))").Error
+	if err != nil {
+		return err
+	}
+
+	if legacyAssociations {
+		if err := migrateLegacyAssociations(db); err != nil {
+			return err
+		}
+	}
+
+	// associations made before the target URI was stored
+	err = db.Exec(
+		"UPDATE associations SET target_uri = record_keys.uri " +
+			"FROM record_keys WHERE record_keys.id = associations.target_id AND associations.target_uri = ''",
+	).Error
+	if err != nil {
+		return err
+	}
+
+	if countersMissing {
+		err = db.Exec(
+			"INSERT INTO association_counters (target_id, schema, variant, count, first_c_date) " +
+				"SELECT target_id, schema, variant, COUNT(*), MIN(c_date) FROM associations " +
+				"WHERE target_id IS NOT NULL GROUP BY target_id, schema, variant",
+		).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return migrateSearch(db)
+}
+
+// migrateLegacyAssociations fills the author, variant and value of associations from the document
+// they stored, and recomputes their unique hash. Of associations which turn out to be duplicates,
+// the newest is kept.
+func migrateLegacyAssociations(db *gorm.DB) error {
+	var associations []models.Association
+	err := db.Preload("Target").Order("c_date DESC").Find(&associations).Error
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, association := range associations {
+		var doc concrnt.Document[any]
+		if err := json.Unmarshal([]byte(association.Value), &doc); err != nil {
+			return err
+		}
+		variant := ""
+		if doc.AssociationVariant != nil {
+			variant = *doc.AssociationVariant
+		}
+		value, err := json.Marshal(doc.Value)
+		if err != nil {
+			return err
+		}
+
+		unique := domain.AssociationUnique(association.Owner, association.Target.URI, doc.Schema, variant)
+		if seen[unique] {
+			if err := db.Delete(&models.Association{}, "document_id = ?", association.DocumentID).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		seen[unique] = true
+
+		err = db.Model(&models.Association{}).
+			Where("document_id = ?", association.DocumentID).
+			Updates(map[string]any{
+				"unique":  unique,
+				"author":  doc.Author,
+				"schema":  doc.Schema,
+				"variant": variant,
+				"value":   string(value),
+			}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateSearch creates the indexes of the search entries. Words are matched with a full-text index,
+// substrings with a bigram index when pg_bigm is available and a trigram index otherwise, which also
+// covers languages without spaces between words such as Japanese.
+func migrateSearch(db *gorm.DB) error {
+	err := db.Exec(
+		"CREATE INDEX IF NOT EXISTS idx_search_entries_tsv ON search_entries USING gin (to_tsvector('simple', text))",
+	).Error
+	if err != nil {
+		return err
+	}
+
+	if db.Exec("CREATE EXTENSION IF NOT EXISTS pg_bigm").Error == nil {
+		return db.Exec(
+			"CREATE INDEX IF NOT EXISTS idx_search_entries_bigm ON search_entries USING gin (text gin_bigm_ops)",
+		).Error
+	}
+
+	if err := db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error; err != nil {
+		log.Printf("search: neither pg_bigm nor pg_trgm is available, substring search is not indexed: %v", err)
+		return nil
+	}
+	return db.Exec(
+		"CREATE INDEX IF NOT EXISTS idx_search_entries_trgm ON search_entries USING gin (text gin_trgm_ops)",
+	).Error
 }
@@ -0,0 +1,142 @@
+package election
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Lock is a lease owned by at most one instance at a time.
+// Calling TryAcquire while holding the lock renews it.
+type Lock interface {
+	TryAcquire(ctx context.Context, name string) (bool, error)
+	Release(ctx context.Context, name string) error
+}
+
+// Elector runs named leaderships on top of a Lock.
+type Elector struct {
+	lock  Lock
+	ttl   time.Duration
+	retry time.Duration
+}
+
+func New(lock Lock, ttl time.Duration) *Elector {
+	return &Elector{
+		lock:  lock,
+		ttl:   ttl,
+		retry: ttl / 5,
+	}
+}
+
+// Run campaigns for name until ctx is done or lead returns by itself.
+// lead is called with a context that is canceled as soon as the leadership is lost.
+func (e *Elector) Run(ctx context.Context, name string, lead func(ctx context.Context)) {
+	for {
+		ok, err := e.lock.TryAcquire(ctx, name)
+		if err != nil {
+			slog.WarnContext(
+				ctx, "Failed to acquire leadership",
+				slog.String("name", name),
+				slog.String("error", err.Error()),
+				slog.String("module", "election"),
+			)
+		}
+
+		if ok {
+			slog.InfoContext(
+				ctx, "Became leader",
+				slog.String("name", name),
+				slog.String("module", "election"),
+			)
+
+			finished := e.lead(ctx, name, lead)
+
+			// release explicitly so that another instance can take over without waiting for expiry
+			releaseCtx, cancel := context.WithTimeout(context.Background(), e.retry)
+			err := e.lock.Release(releaseCtx, name)
+			cancel()
+			if err != nil {
+				slog.WarnContext(
+					ctx, "Failed to release leadership",
+					slog.String("name", name),
+					slog.String("error", err.Error()),
+					slog.String("module", "election"),
+				)
+			}
+
+			if finished {
+				return
+			}
+		}
+
+		select {
+		case <-time.After(e.retry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// lead runs fn while renewing the lock. It reports whether fn returned by itself.
+func (e *Elector) lead(ctx context.Context, name string, fn func(ctx context.Context)) bool {
+	leadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn(leadCtx)
+	}()
+
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return ctx.Err() == nil
+		case <-ctx.Done():
+			cancel()
+			<-done
+			return false
+		case <-ticker.C:
+			ok, err := e.lock.TryAcquire(ctx, name)
+			if err != nil || !ok {
+				// step down before the lease can expire to never have two leaders
+				slog.WarnContext(
+					ctx, "Lost leadership",
+					slog.String("name", name),
+					slog.String("module", "election"),
+				)
+				cancel()
+				<-done
+				return false
+			}
+		}
+	}
+}
+
+// Local grants every leadership immediately. It is used for single instance deployments.
+type Local struct{}
+
+func NewLocal() *Local {
+	return &Local{}
+}
+
+func (l *Local) Run(ctx context.Context, name string, lead func(ctx context.Context)) {
+	lead(ctx)
+}
+
+// InstanceID returns an identifier unique to this process, based on the hostname (the pod name on kubernetes).
+func InstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "concrnt"
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return hostname + "-" + hex.EncodeToString(suffix)
+}
@@ -0,0 +1,250 @@
+package election
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// microTime is the serialization of metav1.MicroTime.
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// KubernetesLock is a Lock backed by coordination.k8s.io/v1 Lease objects.
+// It talks to the API server with the in-cluster service account, which needs
+// get, create and update permissions on leases in its namespace.
+type KubernetesLock struct {
+	http      *http.Client
+	server    string
+	namespace string
+	id        string
+	ttl       time.Duration
+}
+
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+func NewKubernetesLock(id string, ttl time.Duration) (*KubernetesLock, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a kubernetes cluster")
+	}
+
+	namespace, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid service account ca certificate")
+	}
+
+	return &KubernetesLock{
+		http: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+		server:    "https://" + net.JoinHostPort(host, port),
+		namespace: strings.TrimSpace(string(namespace)),
+		id:        id,
+		ttl:       ttl,
+	}, nil
+}
+
+func (l *KubernetesLock) TryAcquire(ctx context.Context, name string) (bool, error) {
+	now := time.Now()
+
+	current, err := l.get(ctx, name)
+	if err != nil {
+		return false, err
+	}
+
+	if current == nil {
+		created := l.newLease(name, now)
+		return l.write(ctx, http.MethodPost, l.collectionURL(), created)
+	}
+
+	spec := &current.Spec
+	if spec.HolderIdentity != l.id {
+		if spec.HolderIdentity != "" && !l.expired(spec, now) {
+			return false, nil
+		}
+		spec.HolderIdentity = l.id
+		spec.AcquireTime = now.UTC().Format(microTime)
+		spec.LeaseTransitions++
+	}
+	spec.LeaseDurationSeconds = int(l.ttl.Seconds())
+	spec.RenewTime = now.UTC().Format(microTime)
+
+	// the resourceVersion makes the update fail if another instance changed the lease meanwhile
+	return l.write(ctx, http.MethodPut, l.leaseURL(current.Metadata.Name), current)
+}
+
+func (l *KubernetesLock) Release(ctx context.Context, name string) error {
+	current, err := l.get(ctx, name)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Spec.HolderIdentity != l.id {
+		return nil
+	}
+
+	current.Spec.HolderIdentity = ""
+	_, err = l.write(ctx, http.MethodPut, l.leaseURL(current.Metadata.Name), current)
+	return err
+}
+
+func (l *KubernetesLock) expired(spec *leaseSpec, now time.Time) bool {
+	renewed, err := time.Parse(microTime, spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return now.After(renewed.Add(time.Duration(spec.LeaseDurationSeconds) * time.Second))
+}
+
+func (l *KubernetesLock) newLease(name string, now time.Time) *lease {
+	return &lease{
+		APIVersion: "coordination.k8s.io/v1",
+		Kind:       "Lease",
+		Metadata: leaseMetadata{
+			Name:      leaseName(name),
+			Namespace: l.namespace,
+		},
+		Spec: leaseSpec{
+			HolderIdentity:       l.id,
+			LeaseDurationSeconds: int(l.ttl.Seconds()),
+			AcquireTime:          now.UTC().Format(microTime),
+			RenewTime:            now.UTC().Format(microTime),
+		},
+	}
+}
+
+func (l *KubernetesLock) get(ctx context.Context, name string) (*lease, error) {
+	resp, err := l.do(ctx, http.MethodGet, l.leaseURL(leaseName(name)), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to get lease %s: %s %s", name, resp.Status, body)
+	}
+
+	var result lease
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// write creates or updates the lease. Conflicts mean another instance won and are not errors.
+func (l *KubernetesLock) write(ctx context.Context, method, url string, obj *lease) (bool, error) {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := l.do(ctx, method, url, body)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return false, fmt.Errorf("failed to write lease %s: %s %s", obj.Metadata.Name, resp.Status, body)
+	}
+}
+
+func (l *KubernetesLock) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	// bound service account tokens are rotated, so read it on every request
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return l.http.Do(req)
+}
+
+func (l *KubernetesLock) collectionURL() string {
+	return l.server + "/apis/coordination.k8s.io/v1/namespaces/" + l.namespace + "/leases"
+}
+
+func (l *KubernetesLock) leaseURL(name string) string {
+	return l.collectionURL() + "/" + name
+}
+
+var invalidLeaseChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// leaseName turns a leadership name into a valid object name.
+// A hash keeps names distinct which only differ in replaced characters.
+func leaseName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	readable := strings.Trim(invalidLeaseChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if len(readable) > 40 {
+		readable = readable[:40]
+	}
+	return "concrnt-" + readable + "-" + hex.EncodeToString(sum[:6])
+}
@@ -0,0 +1,57 @@
+package election
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisLockPrefix = "concrnt:lease:"
+
+var acquireScript = redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if current == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+if not current then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+return 0
+`)
+
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// RedisLock is a Lock backed by a Redis key with an expiry.
+type RedisLock struct {
+	rdb *redis.Client
+	id  string
+	ttl time.Duration
+}
+
+func NewRedisLock(rdb *redis.Client, id string, ttl time.Duration) *RedisLock {
+	return &RedisLock{
+		rdb: rdb,
+		id:  id,
+		ttl: ttl,
+	}
+}
+
+func (l *RedisLock) TryAcquire(ctx context.Context, name string) (bool, error) {
+	result, err := acquireScript.Run(ctx, l.rdb, []string{redisLockPrefix + name}, l.id, l.ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+	return result == 1, nil
+}
+
+func (l *RedisLock) Release(ctx context.Context, name string) error {
+	return releaseScript.Run(ctx, l.rdb, []string{redisLockPrefix + name}, l.id).Err()
+}
@@ -1,35 +1,60 @@
 package gateway
 
 import (
+	"container/heap"
 	"context"
 	"fmt"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/concrnt/chunkline"
 	"github.com/patrickmn/go-cache"
+	"github.com/zeebo/xxh3"
 
 	"github.com/totegamma/concrnt-playground"
 	"github.com/totegamma/concrnt-playground/client"
+	"github.com/totegamma/concrnt-playground/internal/domain"
+	"github.com/totegamma/concrnt-playground/internal/infra/database"
 	"github.com/totegamma/concrnt-playground/internal/usecase"
 )
 
+const (
+	removedItemsTTL = 30 * time.Second
+	openChunkTTL    = 5 * time.Second
+
+	maxParallelRequests  = 16
+	maxRequestsPerServer = 4
+	// maxBatchSize matches the limit of the batch endpoints
+	maxBatchSize = 100
+)
+
 type ChunklineGateway struct {
-	client   *client.Client
-	cache    *cache.Cache
-	resolver *chunkline.Client
+	client    *client.Client
+	cache     *cache.Cache
+	resolver  *chunkline.Client
+	timelines *resolver
 }
 
-func NewChunklineGateway(cl *client.Client) *ChunklineGateway {
+// NewChunklineGateway creates a gateway which reads timelines owned by this server from local
+// and fetches the others from their servers.
+func NewChunklineGateway(config *domain.Config, cl *client.Client, mc *memcache.Client, local usecase.ChunklineRepository) *ChunklineGateway {
 	r := &resolver{
+		config: config,
 		client: cl,
+		mc:     mc,
+		local:  local,
 		cache:  cache.New(10*time.Minute, 15*time.Minute),
 	}
 	return &ChunklineGateway{
-		client:   cl,
-		cache:    r.cache,
-		resolver: chunkline.NewClient(r),
+		client:    cl,
+		cache:     r.cache,
+		resolver:  chunkline.NewClient(r),
+		timelines: r,
 	}
 }
 
@@ -37,130 +62,760 @@ func (g *ChunklineGateway) QueryDescending(ctx context.Context, uris []string, u
 	return g.resolver.QueryDescending(ctx, uris, until, limit)
 }
 
+func (g *ChunklineGateway) QueryAscending(ctx context.Context, uris []string, since time.Time, limit int) ([]chunkline.BodyItem, error) {
+
+	manifests, err := g.timelines.ResolveTimelines(ctx, uris)
+	if err != nil {
+		return nil, err
+	}
+
+	cancelMap, err := g.timelines.GetRemovedItems(ctx, uris)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := make(map[string]chunkline.BodyChunk)
+	pq := make(ascendingQueue, 0)
+	heap.Init(&pq)
+
+	var mu sync.Mutex
+	err = g.timelines.parallel(ctx, uris, func(ctx context.Context, tl string, local bool) error {
+		manifest := manifests[tl]
+		chunk, index, err := g.timelines.seekAscending(ctx, tl, manifest, manifest.Time2Chunk(since), func(t time.Time) bool {
+			return t.After(since)
+		})
+		if err != nil {
+			return err
+		}
+		if index < 0 {
+			return nil
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		chunks[tl] = chunk
+		heap.Push(&pq, &chunkline.QueueItem{
+			Timeline: tl,
+			Item:     chunk.Items[index],
+			Index:    index,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result []chunkline.BodyItem
+	var uniq = make(map[string]bool)
+
+	var itrlimit = 1000
+	for len(result) < limit && pq.Len() > 0 && itrlimit > 0 {
+		itrlimit--
+		oldest := heap.Pop(&pq).(*chunkline.QueueItem)
+		_, exists := uniq[oldest.Item.ID()]
+		retracted := slices.Contains(cancelMap[oldest.Timeline], oldest.Item.ID())
+
+		if !exists && !retracted {
+			result = append(result, oldest.Item)
+			uniq[oldest.Item.ID()] = true
+		}
+
+		nextIndex := oldest.Index + 1
+		timeline := oldest.Timeline
+
+		if nextIndex < len(chunks[timeline].Items) {
+			heap.Push(&pq, &chunkline.QueueItem{
+				Timeline: timeline,
+				Item:     chunks[timeline].Items[nextIndex],
+				Index:    nextIndex,
+			})
+			continue
+		}
+
+		// a body may be cut off inside the chunk of its last item, so continue from that chunk
+		nextChunkID := manifests[timeline].Time2Chunk(oldest.Item.Timestamp)
+		if nextChunkID <= chunks[timeline].ChunkID {
+			nextChunkID = chunks[timeline].ChunkID + 1
+		}
+
+		// items at the same timestamp may be repeated, they are deduplicated above
+		nextChunk, index, err := g.timelines.seekAscending(ctx, timeline, manifests[timeline], nextChunkID, func(t time.Time) bool {
+			return !t.Before(oldest.Item.Timestamp)
+		})
+		if err != nil || index < 0 {
+			continue
+		}
+		chunks[timeline] = nextChunk
+		heap.Push(&pq, &chunkline.QueueItem{
+			Timeline: timeline,
+			Item:     nextChunk.Items[index],
+			Index:    index,
+		})
+	}
+
+	return result, nil
+}
+
+// ascendingQueue is a min-heap of chunkline.QueueItem by timestamp.
+type ascendingQueue []*chunkline.QueueItem
+
+func (pq ascendingQueue) Len() int { return len(pq) }
+func (pq ascendingQueue) Less(i, j int) bool {
+	return pq[i].Item.Timestamp.Before(pq[j].Item.Timestamp)
+}
+func (pq ascendingQueue) Swap(i, j int) {
+	pq[i], pq[j] = pq[j], pq[i]
+}
+func (pq *ascendingQueue) Push(x any) {
+	*pq = append(*pq, x.(*chunkline.QueueItem))
+}
+func (pq *ascendingQueue) Pop() any {
+	old := *pq
+	n := len(old)
+	item := old[n-1]
+	*pq = old[0 : n-1]
+	return item
+}
+
 // resolver implements chunkline resolver callbacks.
 type resolver struct {
+	config *domain.Config
 	client *client.Client
+	mc     *memcache.Client
+	local  usecase.ChunklineRepository
 	cache  *cache.Cache
 }
 
+// home returns the domain of the server which stores the timeline.
+func (r *resolver) home(ctx context.Context, tl string) (string, error) {
+	return resolveHome(ctx, r.config, r.client, tl)
+}
+
+// resolveHome returns the domain of the server which stores the resource at uri.
+func resolveHome(ctx context.Context, config *domain.Config, cl *client.Client, uri string) (string, error) {
+
+	owner, _, hint, err := concrnt.ParseCCURIWithHint(uri)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse URI %s: %v", uri, err)
+	}
+
+	switch {
+	case concrnt.IsCCID(owner):
+		entity, err := cl.GetEntity(ctx, owner, hint)
+		if err != nil {
+			return "", err
+		}
+		return entity.Domain, nil
+	case concrnt.IsCSID(owner):
+		if owner == config.CSID {
+			return config.FQDN, nil
+		}
+		wkc, err := cl.GetServer(ctx, owner, hint)
+		if err != nil {
+			return "", err
+		}
+		return wkc.Domain, nil
+	default:
+		return owner, nil
+	}
+}
+
+// task is a unit of work against one server. Tasks for this server have an empty server.
+type task struct {
+	server string
+	run    func(ctx context.Context) error
+}
+
+// runTasks runs tasks concurrently, with at most maxParallelRequests in flight and at most
+// maxRequestsPerServer of them against the same remote server. The first error cancels the rest.
+func runTasks(ctx context.Context, tasks []task) error {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		firstErr  error
+		global    = make(chan struct{}, maxParallelRequests)
+		perServer = make(map[string]chan struct{})
+	)
+
+	for _, t := range tasks {
+		if _, ok := perServer[t.server]; !ok && t.server != "" {
+			perServer[t.server] = make(chan struct{}, maxRequestsPerServer)
+		}
+	}
+
+	acquire := func(sem chan struct{}) bool {
+		select {
+		case sem <- struct{}{}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for _, t := range tasks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if sem, ok := perServer[t.server]; ok {
+				if !acquire(sem) {
+					return
+				}
+				defer func() { <-sem }()
+			}
+
+			if !acquire(global) {
+				return
+			}
+			defer func() { <-global }()
+
+			err := t.run(ctx)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if firstErr == nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return firstErr
+}
+
+// groupByServer groups timelines by the server storing them. Timelines of this server are grouped under "".
+func (r *resolver) groupByServer(ctx context.Context, timelines []string) (map[string][]string, error) {
+
+	var mu sync.Mutex
+	groups := make(map[string][]string)
+
+	tasks := make([]task, 0, len(timelines))
+	for _, tl := range timelines {
+		tasks = append(tasks, task{run: func(ctx context.Context) error {
+			home, err := r.home(ctx, tl)
+			if err != nil {
+				return fmt.Errorf("failed to resolve timeline %s: %v", tl, err)
+			}
+			if home == r.config.FQDN {
+				home = ""
+			}
+			mu.Lock()
+			groups[home] = append(groups[home], tl)
+			mu.Unlock()
+			return nil
+		}})
+	}
+
+	err := runTasks(ctx, tasks)
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// parallel calls fn for every timeline through runTasks. local tells whether the timeline is stored on this server.
+func (r *resolver) parallel(ctx context.Context, timelines []string, fn func(ctx context.Context, tl string, local bool) error) error {
+
+	groups, err := r.groupByServer(ctx, timelines)
+	if err != nil {
+		return err
+	}
+
+	tasks := make([]task, 0, len(timelines))
+	for server, tls := range groups {
+		for _, tl := range tls {
+			tasks = append(tasks, task{server: server, run: func(ctx context.Context) error {
+				return fn(ctx, tl, server == "")
+			}})
+		}
+	}
+	return runTasks(ctx, tasks)
+}
+
 func (r *resolver) ResolveTimelines(ctx context.Context, timelines []string) (map[string]chunkline.Manifest, error) {
 
-	result := make(map[string]chunkline.Manifest)
+	manifests, err := r.resolveManifests(ctx, timelines)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]chunkline.Manifest, len(manifests))
+	for tl, manifest := range manifests {
+		result[tl] = manifest.Manifest
+	}
+	return result, nil
+}
+
+func (r *resolver) resolveManifests(ctx context.Context, timelines []string) (map[string]concrnt.ChunklineManifest, error) {
+
+	result := make(map[string]concrnt.ChunklineManifest)
 	remaining := []string{}
 
 	for _, tl := range timelines {
 		if cached, found := r.cache.Get(tl); found {
-			result[tl] = cached.(chunkline.Manifest)
+			result[tl] = cached.(concrnt.ChunklineManifest)
 		} else {
 			remaining = append(remaining, tl)
 		}
 	}
 
-	for _, tl := range remaining {
-		var manifest chunkline.Manifest
+	var mu sync.Mutex
+	err := r.parallel(ctx, remaining, func(ctx context.Context, tl string, local bool) error {
+		if local {
+			manifest, err := r.local.GetChunklineManifest(ctx, tl)
+			if err != nil {
+				return fmt.Errorf("failed to resolve timeline %s: %v", tl, err)
+			}
+			mu.Lock()
+			result[tl] = *manifest
+			mu.Unlock()
+			return nil
+		}
+
+		var manifest concrnt.ChunklineManifest
 		err := r.client.GetResource(ctx, tl, "application/chunkline+json", client.Options{}, &manifest)
 		if err != nil {
-			return nil, fmt.Errorf("failed to resolve timeline %s: %v", tl, err)
+			return fmt.Errorf("failed to resolve timeline %s: %v", tl, err)
 		}
-		result[tl] = manifest
 		r.cache.Set(tl, manifest, cache.DefaultExpiration)
+		mu.Lock()
+		result[tl] = manifest
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+
 	return result, nil
 
 }
 
+// GetRemovedItems fetches the removed items of timelines which advertise them.
+// Remote ones are cached briefly, so deletions propagate within removedItemsTTL.
 func (r *resolver) GetRemovedItems(ctx context.Context, timelines []string) (map[string][]string, error) {
+
+	manifests, err := r.resolveManifests(ctx, timelines)
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
 	result := make(map[string][]string)
-	for _, tl := range timelines {
-		result[tl] = []string{}
+	err = r.parallel(ctx, timelines, func(ctx context.Context, tl string, local bool) error {
+
+		var removed []string
+		cacheKey := "removed:" + tl
+		if cached, found := r.cache.Get(cacheKey); found {
+			removed = cached.([]string)
+		} else if local {
+			var err error
+			removed, err = r.local.GetRemovedItems(ctx, tl)
+			if err != nil {
+				return err
+			}
+		} else if manifest := manifests[tl]; manifest.Removed != "" {
+			owner, _, err := concrnt.ParseCCURI(tl)
+			if err != nil {
+				return fmt.Errorf("failed to parse timeline URI %s: %v", tl, err)
+			}
+
+			err = r.client.HttpRequest(ctx, "GET", owner, manifest.Removed, &removed)
+			if err != nil {
+				return err
+			}
+			r.cache.Set(cacheKey, removed, removedItemsTTL)
+		} else {
+			removed = []string{}
+		}
+
+		mu.Lock()
+		result[tl] = removed
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+
 	return result, nil
 }
 
+// LookupChunkItrs looks up the iterators of a server's timelines at the same chunk in one batch request
+// where the server supports it.
 func (r *resolver) LookupChunkItrs(ctx context.Context, timelines []string, until time.Time) (map[string]string, error) {
 
-	manifests, err := r.ResolveTimelines(ctx, timelines)
+	manifests, err := r.resolveManifests(ctx, timelines)
 	if err != nil {
 		return nil, err
 	}
 
-	results := make(map[string]string)
-	for _, tl := range timelines {
+	groups, err := r.groupByServer(ctx, timelines)
+	if err != nil {
+		return nil, err
+	}
 
-		manifest := manifests[tl]
+	var mu sync.Mutex
+	results := make(map[string]string)
 
-		if manifest.Descending.Iterator == "" {
-			return nil, fmt.Errorf("timeline %s does not support descending iteration", tl)
-		}
+	type batchKey struct {
+		chunkID int64
+		path    string
+	}
 
-		owner, _, err := concrnt.ParseCCURI(tl)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse timeline URI %s: %v", tl, err)
+	var tasks []task
+	for server, tls := range groups {
+		batches := make(map[batchKey][]string)
+		for _, tl := range tls {
+			manifest := manifests[tl]
+			chunkID, ok := lookupChunk(manifest.Manifest, until)
+			if !ok {
+				results[tl] = "0"
+				continue
+			}
+
+			switch {
+			case server == "":
+				batches[batchKey{chunkID: chunkID}] = append(batches[batchKey{chunkID: chunkID}], tl)
+			case manifest.Batch != nil && manifest.Batch.Iterator != "":
+				key := batchKey{chunkID: chunkID, path: manifest.Batch.Iterator}
+				batches[key] = append(batches[key], tl)
+			default:
+				tasks = append(tasks, task{server: server, run: func(ctx context.Context) error {
+					itr, err := r.lookupItr(ctx, tl, manifest.Manifest, chunkID)
+					if err != nil {
+						return err
+					}
+					mu.Lock()
+					results[tl] = itr
+					mu.Unlock()
+					return nil
+				}})
+			}
 		}
 
-		result, err := r.client.HttpRequestText(
-			ctx,
-			"GET",
-			owner,
-			strings.ReplaceAll(manifest.Descending.Iterator, "{chunk}", fmt.Sprintf("%d", manifest.Time2Chunk(until))),
-		)
-		if err != nil {
-			return nil, err
+		for key, batch := range batches {
+			for part := range slices.Chunk(batch, maxBatchSize) {
+				tasks = append(tasks, task{server: server, run: func(ctx context.Context) error {
+					var itrs map[string]int64
+					var err error
+					if server == "" {
+						itrs, err = r.local.LookupLocalItrs(ctx, part, key.chunkID)
+					} else {
+						err = r.client.PostJSON(ctx, server, key.path, concrnt.ChunklineItrBatchRequest{
+							URIs:  part,
+							Chunk: key.chunkID,
+						}, &itrs)
+					}
+					if err != nil {
+						return err
+					}
+
+					mu.Lock()
+					for _, tl := range part {
+						results[tl] = strconv.FormatInt(itrs[tl], 10)
+					}
+					mu.Unlock()
+					return nil
+				}})
+			}
 		}
+	}
 
-		results[tl] = result
+	err = runTasks(ctx, tasks)
+	if err != nil {
+		return nil, err
 	}
+
 	return results, nil
 }
 
+// lookupChunk returns the chunk to look up for until, limited to the chunks the manifest says exist.
+// Static exports set LastChunk to the last chunk they hold. It reports false when no chunk is at or before until.
+func lookupChunk(manifest chunkline.Manifest, until time.Time) (int64, bool) {
+	chunkID := manifest.Time2Chunk(until)
+	if manifest.LastChunk > 0 && chunkID > manifest.LastChunk {
+		chunkID = manifest.LastChunk
+	}
+	return chunkID, chunkID >= manifest.FirstChunk
+}
+
+func (r *resolver) lookupItr(ctx context.Context, tl string, manifest chunkline.Manifest, chunkID int64) (string, error) {
+
+	if manifest.Descending == nil || manifest.Descending.Iterator == "" {
+		return "", fmt.Errorf("timeline %s does not support descending iteration", tl)
+	}
+
+	owner, _, err := concrnt.ParseCCURI(tl)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse timeline URI %s: %v", tl, err)
+	}
+
+	return r.client.HttpRequestText(
+		ctx,
+		"GET",
+		owner,
+		strings.ReplaceAll(manifest.Descending.Iterator, "{chunk}", fmt.Sprintf("%d", chunkID)),
+	)
+}
+
+// LoadChunkBodies loads the bodies of a server's timelines in batch requests where the server supports it.
 func (r *resolver) LoadChunkBodies(ctx context.Context, query map[string]string) (map[string]chunkline.BodyChunk, error) {
 
 	uris := []string{}
-	for itr := range query {
-		uris = append(uris, itr)
+	chunkIDs := make(map[string]int64, len(query))
+	for tl, itr := range query {
+		chunkID, err := strconv.ParseInt(itr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk ID %s: %v", itr, err)
+		}
+		uris = append(uris, tl)
+		chunkIDs[tl] = chunkID
+	}
+
+	manifests, err := r.resolveManifests(ctx, uris)
+	if err != nil {
+		return nil, err
 	}
 
-	manifests, err := r.ResolveTimelines(ctx, uris)
+	groups, err := r.groupByServer(ctx, uris)
 	if err != nil {
 		return nil, err
 	}
 
+	var mu sync.Mutex
 	result := make(map[string]chunkline.BodyChunk)
-	for tl, itr := range query {
+	store := func(tl string, items []chunkline.BodyItem) {
+		mu.Lock()
+		defer mu.Unlock()
+		result[tl] = chunkline.BodyChunk{
+			URI:     tl,
+			ChunkID: chunkIDs[tl],
+			Items:   items,
+		}
+	}
 
-		manifest := manifests[tl]
+	var tasks []task
+	for server, tls := range groups {
+		batches := make(map[string][]string)
+		for _, tl := range tls {
+			manifest := manifests[tl]
+			chunkID := chunkIDs[tl]
+
+			switch {
+			case chunkID < manifest.FirstChunk:
+				// there is nothing before the first chunk, and static hosts have no file for it
+				store(tl, []chunkline.BodyItem{})
+			case server == "":
+				tasks = append(tasks, task{run: func(ctx context.Context) error {
+					items, _, err := r.local.LoadLocalBody(ctx, tl, chunkID)
+					if err != nil {
+						return err
+					}
+					store(tl, items)
+					return nil
+				}})
+			case manifest.Batch != nil && manifest.Batch.Body != "":
+				// batch bodies are cached under the batch path, since the manifest need not declare a per-timeline body
+				var items []chunkline.BodyItem
+				if database.GetJSON(r.mc, bodyCacheKey(tl, manifest.Batch.Body, chunkID), &items) {
+					store(tl, items)
+					continue
+				}
+				batches[manifest.Batch.Body] = append(batches[manifest.Batch.Body], tl)
+			case manifest.Descending == nil || manifest.Descending.Body == "":
+				return nil, fmt.Errorf("timeline %s does not serve chunk bodies", tl)
+			default:
+				tasks = append(tasks, task{server: server, run: func(ctx context.Context) error {
+					closed := time.Now().After(manifest.Chunk2Time(chunkID + 1).Add(domain.ChunkCloseGrace))
+					items, err := r.fetchBody(ctx, tl, manifest.Descending.Body, chunkID, closed)
+					if err != nil {
+						return err
+					}
+					store(tl, items)
+					return nil
+				}})
+			}
+		}
 
-		owner, _, err := concrnt.ParseCCURI(tl)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse timeline URI %s: %v", tl, err)
+		for path, batch := range batches {
+			for part := range slices.Chunk(batch, maxBatchSize) {
+				tasks = append(tasks, task{server: server, run: func(ctx context.Context) error {
+					req := concrnt.ChunklineBodyBatchRequest{Chunks: make(map[string]int64, len(part))}
+					for _, tl := range part {
+						req.Chunks[tl] = chunkIDs[tl]
+					}
+
+					var bodies map[string][]chunkline.BodyItem
+					err := r.client.PostJSON(ctx, server, path, req, &bodies)
+					if err != nil {
+						return err
+					}
+
+					for _, tl := range part {
+						manifest := manifests[tl]
+						chunkID := chunkIDs[tl]
+						closed := time.Now().After(manifest.Chunk2Time(chunkID + 1).Add(domain.ChunkCloseGrace))
+						database.SetJSON(r.mc, bodyCacheKey(tl, path, chunkID), bodies[tl], bodyExpiration(closed))
+						store(tl, bodies[tl])
+					}
+					return nil
+				}})
+			}
 		}
+	}
 
-		var items []chunkline.BodyItem
-		err = r.client.HttpRequest(
-			ctx,
-			"GET",
-			owner,
-			strings.ReplaceAll(manifest.Descending.Body, "{chunk}", itr),
-			&items,
-		)
+	err = runTasks(ctx, tasks)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+
+}
+
+// seekAscending loads chunks of tl from chunkID on until one has an item matching from.
+// It returns the chunk and the index of that item, or -1 when the timeline is exhausted.
+func (r *resolver) seekAscending(ctx context.Context, tl string, manifest chunkline.Manifest, chunkID int64, from func(time.Time) bool) (chunkline.BodyChunk, int, error) {
+	for {
+		chunk, err := r.loadAscendingChunk(ctx, tl, manifest, chunkID)
 		if err != nil {
-			return nil, err
+			return chunkline.BodyChunk{}, -1, err
+		}
+		if len(chunk.Items) == 0 {
+			return chunk, -1, nil
 		}
 
-		chunkID, err := strconv.ParseInt(itr, 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("invalid chunk ID %s: %v", itr, err)
+		index := sort.Search(len(chunk.Items), func(i int) bool {
+			return from(chunk.Items[i].Timestamp)
+		})
+		if index < len(chunk.Items) {
+			return chunk, index, nil
 		}
 
-		result[tl] = chunkline.BodyChunk{
+		chunkID = max(manifest.Time2Chunk(chunk.Items[len(chunk.Items)-1].Timestamp), chunk.ChunkID) + 1
+	}
+}
+
+// loadAscendingChunk loads the first non-empty chunk of tl at or after chunkID, oldest first.
+func (r *resolver) loadAscendingChunk(ctx context.Context, tl string, manifest chunkline.Manifest, chunkID int64) (chunkline.BodyChunk, error) {
+
+	home, err := r.home(ctx, tl)
+	if err != nil {
+		return chunkline.BodyChunk{}, fmt.Errorf("failed to resolve timeline %s: %v", tl, err)
+	}
+
+	if home == r.config.FQDN {
+		itrs, err := r.local.LookupLocalAscendingItrs(ctx, []string{tl}, chunkID)
+		if err != nil {
+			return chunkline.BodyChunk{}, err
+		}
+		itrID, ok := itrs[tl]
+		if !ok {
+			return chunkline.BodyChunk{URI: tl, ChunkID: chunkID}, nil
+		}
+		items, _, err := r.local.LoadLocalAscendingBody(ctx, tl, itrID)
+		if err != nil {
+			return chunkline.BodyChunk{}, err
+		}
+		return chunkline.BodyChunk{
 			URI:     tl,
-			ChunkID: chunkID,
+			ChunkID: itrID,
 			Items:   items,
-		}
+		}, nil
+	}
 
+	if manifest.Ascending == nil || manifest.Ascending.Iterator == "" {
+		return chunkline.BodyChunk{}, fmt.Errorf("timeline %s does not support ascending iteration", tl)
+	}
+
+	owner, _, err := concrnt.ParseCCURI(tl)
+	if err != nil {
+		return chunkline.BodyChunk{}, fmt.Errorf("failed to parse timeline URI %s: %v", tl, err)
 	}
-	return result, nil
 
+	itr, err := r.client.HttpRequestText(
+		ctx,
+		"GET",
+		owner,
+		strings.ReplaceAll(manifest.Ascending.Iterator, "{chunk}", fmt.Sprintf("%d", chunkID)),
+	)
+	if err != nil {
+		return chunkline.BodyChunk{}, err
+	}
+
+	itrID, err := strconv.ParseInt(itr, 10, 64)
+	if err != nil {
+		return chunkline.BodyChunk{}, fmt.Errorf("invalid chunk ID %s: %v", itr, err)
+	}
+
+	closed := time.Now().After(manifest.Chunk2Time(itrID + 2).Add(domain.ChunkCloseGrace))
+	items, err := r.fetchBody(ctx, tl, manifest.Ascending.Body, itrID, closed)
+	if err != nil {
+		return chunkline.BodyChunk{}, err
+	}
+
+	return chunkline.BodyChunk{
+		URI:     tl,
+		ChunkID: itrID,
+		Items:   items,
+	}, nil
+}
+
+// fetchBody loads a chunk body of a timeline through memcached. Bodies of closed chunks
+// are kept until evicted, deletions in them are applied through the removed items.
+func (r *resolver) fetchBody(ctx context.Context, tl, template string, chunkID int64, closed bool) ([]chunkline.BodyItem, error) {
+
+	cacheKey := bodyCacheKey(tl, template, chunkID)
+	var items []chunkline.BodyItem
+	if database.GetJSON(r.mc, cacheKey, &items) {
+		return items, nil
+	}
+
+	owner, _, err := concrnt.ParseCCURI(tl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse timeline URI %s: %v", tl, err)
+	}
+
+	err = r.client.HttpRequest(
+		ctx,
+		"GET",
+		owner,
+		strings.ReplaceAll(template, "{chunk}", strconv.FormatInt(chunkID, 10)),
+		&items,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	database.SetJSON(r.mc, cacheKey, items, bodyExpiration(closed))
+
+	return items, nil
+}
+
+// bodyCacheKey is the memcached key of a remote chunk body, keyed by the path it was loaded
+// through: the body template for single loads and the batch path for batch loads. Manifests
+// need not declare a per-timeline body next to a batch endpoint, so the two are cached apart.
+func bodyCacheKey(tl, template string, chunkID int64) string {
+	return fmt.Sprintf("chunkline:remote:%x:%d", xxh3.HashString(tl+" "+template), chunkID)
+}
+
+// bodyExpiration keeps closed bodies only as long as their removed items are listed.
+func bodyExpiration(closed bool) time.Duration {
+	if closed {
+		return domain.RemovedItemsRetention
+	}
+	return openChunkTTL
 }
 
 var _ usecase.ChunklineGateway = (*ChunklineGateway)(nil)
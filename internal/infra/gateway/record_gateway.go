@@ -0,0 +1,112 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/totegamma/concrnt-playground"
+	"github.com/totegamma/concrnt-playground/client"
+	"github.com/totegamma/concrnt-playground/internal/domain"
+)
+
+// RecordGateway delivers commits on records of other servers to the servers storing them
+// and fetches documents from them.
+type RecordGateway struct {
+	config *domain.Config
+	client *client.Client
+}
+
+func NewRecordGateway(config *domain.Config, cl *client.Client) *RecordGateway {
+	return &RecordGateway{config: config, client: cl}
+}
+
+// Home returns the domain of the server which stores the record at uri.
+func (g *RecordGateway) Home(ctx context.Context, uri string) (string, error) {
+	return resolveHome(ctx, g.config, g.client, uri)
+}
+
+// IsLocal reports whether domain is this server.
+func (g *RecordGateway) IsLocal(domain string) bool {
+	return domain == g.config.FQDN
+}
+
+// Deliver commits sd on the server at domain.
+func (g *RecordGateway) Deliver(ctx context.Context, domain string, sd concrnt.SignedDocument) error {
+	var response any
+	err := g.client.PostJSON(ctx, domain, "/commit", sd, &response)
+	if err != nil {
+		return fmt.Errorf("failed to deliver to %s: %w", domain, err)
+	}
+	return nil
+}
+
+// FetchResources fetches the signed documents at uris from the servers storing them, one request per server.
+// Failures are reported per URI, and URIs of this server are reported as not found.
+func (g *RecordGateway) FetchResources(ctx context.Context, uris []string) map[string]concrnt.ResourceBatchItem {
+
+	var mu sync.Mutex
+	results := make(map[string]concrnt.ResourceBatchItem, len(uris))
+	fail := func(uris []string, err string) {
+		mu.Lock()
+		for _, uri := range uris {
+			results[uri] = concrnt.ResourceBatchItem{Error: err}
+		}
+		mu.Unlock()
+	}
+
+	groups := make(map[string][]string)
+	tasks := make([]task, 0, len(uris))
+	for _, uri := range uris {
+		tasks = append(tasks, task{run: func(ctx context.Context) error {
+			home, err := g.Home(ctx, uri)
+			if err != nil {
+				fail([]string{uri}, "failed to resolve home server")
+				return nil
+			}
+			if g.IsLocal(home) {
+				fail([]string{uri}, "not found")
+				return nil
+			}
+			mu.Lock()
+			groups[home] = append(groups[home], uri)
+			mu.Unlock()
+			return nil
+		}})
+	}
+	runTasks(ctx, tasks)
+
+	tasks = tasks[:0]
+	for server, serverURIs := range groups {
+		for start := 0; start < len(serverURIs); start += maxBatchSize {
+			batch := serverURIs[start:min(start+maxBatchSize, len(serverURIs))]
+			tasks = append(tasks, task{server: server, run: func(ctx context.Context) error {
+				items, err := g.client.GetResources(ctx, server, batch)
+				if err != nil {
+					fail(batch, err.Error())
+					return nil
+				}
+				mu.Lock()
+				for _, uri := range batch {
+					item, ok := items[uri]
+					if !ok {
+						item = concrnt.ResourceBatchItem{Error: "not found"}
+					}
+					results[uri] = item
+				}
+				mu.Unlock()
+				return nil
+			}})
+		}
+	}
+	runTasks(ctx, tasks)
+
+	// tasks cancelled with ctx leave their URIs unanswered
+	for _, uri := range uris {
+		if _, ok := results[uri]; !ok {
+			results[uri] = concrnt.ResourceBatchItem{Error: "cancelled"}
+		}
+	}
+
+	return results
+}
@@ -2,35 +2,234 @@ package repository
 
 import (
 	"context"
+	"fmt"
 	"net/url"
+	"strconv"
 	"time"
 
 	"encoding/json"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 
+	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/concrnt/chunkline"
+	"github.com/patrickmn/go-cache"
 	"github.com/totegamma/concrnt-playground"
+	"github.com/totegamma/concrnt-playground/internal/domain"
+	"github.com/totegamma/concrnt-playground/internal/infra/database"
 	"github.com/totegamma/concrnt-playground/internal/infra/database/models"
 	"github.com/totegamma/concrnt-playground/schemas"
+	"github.com/zeebo/xxh3"
 )
 
 const (
-	defaultChunkSize = 32
+	defaultChunkSize = 600 // seconds
+	defaultBodySize  = 32
+	openChunkTTL     = 5 * time.Second
+	// metadataTTL bounds how long cached collection statistics and removals can miss a change
+	metadataTTL = time.Minute
 )
 
+// ChunklineConfig is the server wide chunk layout. Collections may override it
+// with the "chunkline" property of their document value.
+type ChunklineConfig struct {
+	ChunkSize time.Duration
+	BodySize  int
+}
+
 type ChunklineRepository struct {
-	db *gorm.DB
+	db     *gorm.DB
+	mc     *memcache.Client
+	config ChunklineConfig
+	cache  *cache.Cache
 }
 
-func NewChunklineRepository(db *gorm.DB) *ChunklineRepository {
-	return &ChunklineRepository{db: db}
+func (c ChunklineConfig) withDefaults() ChunklineConfig {
+	if c.ChunkSize < time.Second {
+		c.ChunkSize = defaultChunkSize * time.Second
+	}
+	if c.BodySize <= 0 {
+		c.BodySize = defaultBodySize
+	}
+	return c
 }
 
-func (r *ChunklineRepository) GetChunklineManifest(ctx context.Context, uri string) (*chunkline.Manifest, error) {
-	ctx, span := tracer.Start(ctx, "Repository.Chunkline.GetChunklineManifest")
+func (c ChunklineConfig) layout() chunkLayout {
+	return chunkLayout{
+		chunkSize: int64(c.ChunkSize / time.Second),
+		bodySize:  c.BodySize,
+	}
+}
+
+func NewChunklineRepository(db *gorm.DB, mc *memcache.Client, config ChunklineConfig) *ChunklineRepository {
+	return &ChunklineRepository{
+		db:     db,
+		mc:     mc,
+		config: config.withDefaults(),
+		cache:  cache.New(time.Minute, 5*time.Minute),
+	}
+}
+
+// chunkLayout is the effective chunk layout of one collection.
+type chunkLayout struct {
+	chunkSize int64 // seconds
+	bodySize  int
+}
+
+func (l chunkLayout) chunkStart(chunkID int64) time.Time {
+	return time.Unix(chunkID*l.chunkSize, 0)
+}
+
+func (l chunkLayout) chunkOf(t time.Time) int64 {
+	return t.Unix() / l.chunkSize
+}
+
+// override applies the chunkline options of a collection document.
+func (l chunkLayout) override(document string) chunkLayout {
+	var doc concrnt.Document[struct {
+		Chunkline *schemas.ChunklineOptions `json:"chunkline"`
+	}]
+	err := json.Unmarshal([]byte(document), &doc)
+	if err == nil && doc.Value.Chunkline != nil {
+		if doc.Value.Chunkline.ChunkSize > 0 {
+			l.chunkSize = doc.Value.Chunkline.ChunkSize
+		}
+		if doc.Value.Chunkline.BodySize > 0 {
+			l.bodySize = doc.Value.Chunkline.BodySize
+		}
+	}
+	return l
+}
+
+// descendingClosed reports whether the descending body of chunkID can no longer gain items.
+func (l chunkLayout) descendingClosed(chunkID int64) bool {
+	return time.Now().After(l.chunkStart(chunkID + 1).Add(domain.ChunkCloseGrace))
+}
+
+// ascendingClosed reports whether the ascending body of chunkID can no longer gain items.
+func (l chunkLayout) ascendingClosed(chunkID int64) bool {
+	return time.Now().After(l.chunkStart(chunkID + 2).Add(domain.ChunkCloseGrace))
+}
+
+func bodyExpiration(closed bool) time.Duration {
+	if closed {
+		return 0
+	}
+	return openChunkTTL
+}
+
+// bodyCacheKey returns the memcached key of a chunk body. Keys embed generations of the
+// collection: deletions bump the generation and so drop all of its bodies, creations bump
+// the open generation and so drop the bodies of open chunks.
+func (r *ChunklineRepository) bodyCacheKey(direction, uri string, chunkID int64, closed bool) string {
+	hash := fmt.Sprintf("%x", xxh3.HashString(uri))
+	gens := r.generations(generationKeys(hash))
+	if closed {
+		return fmt.Sprintf("chunkline:body:%s:%s:%s:%d", direction, hash, gens[0], chunkID)
+	}
+	return fmt.Sprintf("chunkline:body:%s:%s:%s.%s:%d", direction, hash, gens[0], gens[1], chunkID)
+}
+
+func generationKeys(hash string) (string, string) {
+	return "chunkline:gen:" + hash, "chunkline:opengen:" + hash
+}
+
+func (r *ChunklineRepository) generations(keys ...string) []string {
+	items, _ := r.mc.GetMulti(keys)
+
+	result := make([]string, len(keys))
+	for i, key := range keys {
+		if item, ok := items[key]; ok {
+			result[i] = string(item.Value)
+			continue
+		}
+
+		// start from a unique value, so that bodies cached before an eviction are never reused
+		gen := strconv.FormatInt(time.Now().UnixNano(), 10)
+		err := r.mc.Add(&memcache.Item{Key: key, Value: []byte(gen)})
+		if err == memcache.ErrNotStored {
+			if item, err := r.mc.Get(key); err == nil {
+				gen = string(item.Value)
+			}
+		}
+		result[i] = gen
+	}
+	return result
+}
+
+// Invalidate drops cached bodies affected by a published event. The channel is either
+// a member of a collection or, for removals, the collection itself, so both are invalidated.
+func (r *ChunklineRepository) Invalidate(ctx context.Context, channel string, event concrnt.Event) {
+	uris := []string{channel}
+	parentURI, err := url.JoinPath(channel, "..")
+	if err == nil {
+		uris = append(uris, parentURI)
+	}
+
+	for _, uri := range uris {
+		genKey, openKey := generationKeys(fmt.Sprintf("%x", xxh3.HashString(uri)))
+		// a missing generation is restarted by the next reader, so misses need no handling
+		if event.Type == "deleted" {
+			r.mc.Increment(genKey, 1)
+		} else {
+			r.mc.Increment(openKey, 1)
+		}
+	}
+}
+
+// getLayout returns the record key of the collection at uri and its chunk layout.
+func (r *ChunklineRepository) getLayout(ctx context.Context, uri string) (*models.RecordKey, chunkLayout, error) {
+	ctx, span := tracer.Start(ctx, "Repository.Chunkline.getLayout")
 	defer span.End()
 
 	recordKey, err := GetRecordKeyByURI(ctx, r.db, uri)
+	if err != nil {
+		span.RecordError(err)
+		return nil, chunkLayout{}, err
+	}
+
+	if cached, found := r.cache.Get(uri); found {
+		return recordKey, cached.(chunkLayout), nil
+	}
+
+	layout := r.config.layout()
+
+	if recordKey.RecordID != nil {
+		var commitLog models.CommitLog
+		err = r.db.WithContext(ctx).
+			Where("id = ?", *recordKey.RecordID).
+			Take(&commitLog).Error
+		if err != nil {
+			span.RecordError(err)
+			return nil, chunkLayout{}, err
+		}
+
+		layout = layout.override(commitLog.Document)
+	}
+
+	r.cache.Set(uri, layout, cache.DefaultExpiration)
+	return recordKey, layout, nil
+}
+
+// groupByLayout groups uris by their chunk layout, so that each group can be looked up in one query.
+// Unknown uris are left out.
+func (r *ChunklineRepository) groupByLayout(ctx context.Context, uris []string) map[chunkLayout][]string {
+	groups := make(map[chunkLayout][]string)
+	for _, uri := range uris {
+		_, layout, err := r.getLayout(ctx, uri)
+		if err != nil {
+			continue
+		}
+		groups[layout] = append(groups[layout], uri)
+	}
+	return groups
+}
+
+func (r *ChunklineRepository) GetChunklineManifest(ctx context.Context, uri string) (*concrnt.ChunklineManifest, error) {
+	ctx, span := tracer.Start(ctx, "Repository.Chunkline.GetChunklineManifest")
+	defer span.End()
+
+	recordKey, layout, err := r.getLayout(ctx, uri)
 	if err != nil {
 		span.RecordError(err)
 		return nil, err
@@ -42,34 +241,125 @@ func (r *ChunklineRepository) GetChunklineManifest(ctx context.Context, uri stri
 		return nil, err
 	}
 
+	metadata, err := r.getMetadata(ctx, recordKey)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
 	firstChunk := int64(0)
-	firstCollectionMember := models.RecordKey{}
-	err = r.db.WithContext(ctx).
-		Model(&models.RecordKey{}).
-		Joins("JOIN records r ON r.document_id = record_keys.record_id").
-		Where("record_keys.parent_id = ?", recordKey.ID).
-		Order("r.c_date ASC").
-		Limit(1).
-		Preload("Record").
-		Take(&firstCollectionMember).Error
-	if err == nil {
-		firstChunk = firstCollectionMember.Record.CDate.Unix() / 600
+	if metadata.FirstUpdate != nil {
+		firstChunk = layout.chunkOf(*metadata.FirstUpdate)
 	}
 
 	safekey := url.PathEscape(key)
 
-	return &chunkline.Manifest{
-		Version:    "1.0",
-		ChunkSize:  600,
-		FirstChunk: firstChunk,
-		Descending: &chunkline.Endpoint{
-			Iterator: "/chunkline/" + ccid + "/" + safekey + "/{chunk}/itr",
-			Body:     "/chunkline/" + ccid + "/" + safekey + "/{chunk}/body",
+	return &concrnt.ChunklineManifest{
+		Manifest: chunkline.Manifest{
+			Version:    "1.0",
+			ChunkSize:  layout.chunkSize,
+			FirstChunk: firstChunk,
+			Ascending: &chunkline.Endpoint{
+				Iterator: "/chunkline/" + ccid + "/" + safekey + "/{chunk}/asc/itr",
+				Body:     "/chunkline/" + ccid + "/" + safekey + "/{chunk}/asc/body",
+			},
+			Descending: &chunkline.Endpoint{
+				Iterator: "/chunkline/" + ccid + "/" + safekey + "/{chunk}/itr",
+				Body:     "/chunkline/" + ccid + "/" + safekey + "/{chunk}/body",
+			},
+			Metadata: metadata.ChunklineMetadata,
+		},
+		Removed: "/chunkline/" + ccid + "/" + safekey + "/removed",
+		Batch: &concrnt.ChunklineBatchEndpoint{
+			Iterator: "/chunkline/itr",
+			Body:     "/chunkline/body",
 		},
-		// Metadata: recordKey.Record.Value,
 	}, nil
 }
 
+// documentMetadata describes a timeline by its collection document.
+func documentMetadata(document string) (concrnt.ChunklineMetadata, error) {
+	var doc concrnt.Document[any]
+	err := json.Unmarshal([]byte(document), &doc)
+	if err != nil {
+		return concrnt.ChunklineMetadata{}, err
+	}
+
+	owner := doc.Author
+	if doc.Owner != nil {
+		owner = *doc.Owner
+	}
+
+	return concrnt.ChunklineMetadata{
+		Schema:   doc.Schema,
+		Owner:    owner,
+		Value:    doc.Value,
+		Policies: doc.Policies,
+	}, nil
+}
+
+type collectionMetadata struct {
+	concrnt.ChunklineMetadata
+	FirstUpdate *time.Time `json:"firstUpdate,omitempty"`
+}
+
+// getMetadata reads the collection document of a timeline and the statistics of its members.
+// The result is cached under both generations of the collection, which every commit to it
+// or its members bumps.
+func (r *ChunklineRepository) getMetadata(ctx context.Context, recordKey *models.RecordKey) (collectionMetadata, error) {
+	ctx, span := tracer.Start(ctx, "Repository.Chunkline.getMetadata")
+	defer span.End()
+
+	var metadata collectionMetadata
+
+	hash := fmt.Sprintf("%x", xxh3.HashString(recordKey.URI))
+	gens := r.generations(generationKeys(hash))
+	cacheKey := fmt.Sprintf("chunkline:meta:%s:%s.%s", hash, gens[0], gens[1])
+	if database.GetJSON(r.mc, cacheKey, &metadata) {
+		return metadata, nil
+	}
+
+	if recordKey.RecordID != nil {
+		var commitLog models.CommitLog
+		err := r.db.WithContext(ctx).
+			Where("id = ?", *recordKey.RecordID).
+			Take(&commitLog).Error
+		if err != nil {
+			span.RecordError(err)
+			return metadata, err
+		}
+
+		metadata.ChunklineMetadata, err = documentMetadata(commitLog.Document)
+		if err != nil {
+			span.RecordError(err)
+			return metadata, err
+		}
+	}
+
+	var stats struct {
+		Count int64      `gorm:"column:count"`
+		First *time.Time `gorm:"column:first"`
+		Last  *time.Time `gorm:"column:last"`
+	}
+	err := r.db.WithContext(ctx).
+		Model(&models.RecordKey{}).
+		Select("COUNT(*) AS count, MIN(r.c_date) AS first, MAX(r.c_date) AS last").
+		Joins("JOIN records r ON r.document_id = record_keys.record_id").
+		Where("record_keys.parent_id = ?", recordKey.ID).
+		Scan(&stats).Error
+	if err != nil {
+		span.RecordError(err)
+		return metadata, err
+	}
+
+	metadata.MemberCount = stats.Count
+	metadata.LastUpdate = stats.Last
+	metadata.FirstUpdate = stats.First
+
+	database.SetJSON(r.mc, cacheKey, metadata, metadataTTL)
+	return metadata, nil
+}
+
 func (r *ChunklineRepository) LookupLocalItrs(ctx context.Context, uris []string, chunkID int64) (map[string]int64, error) {
 	ctx, span := tracer.Start(ctx, "Repository.Chunkline.LookupLocalItrs")
 	defer span.End()
@@ -79,57 +369,66 @@ func (r *ChunklineRepository) LookupLocalItrs(ctx context.Context, uris []string
 		MaxCDate time.Time `gorm:"column:max_c_date"`
 	}
 
-	var res []TimelineRow
+	lookup := make(map[string]int64)
+	for layout, group := range r.groupByLayout(ctx, uris) {
+		var res []TimelineRow
 
-	cutoff := time.Unix((chunkID+1)*600, 0) // descending order
+		cutoff := layout.chunkStart(chunkID + 1) // descending order
 
-	err := r.db.WithContext(ctx).
-		Table("record_keys AS parent").
-		Joins("JOIN record_keys AS child ON child.parent_id = parent.id").
-		Joins("JOIN records r ON r.document_id = child.record_id").
-		Select("parent.uri AS uri, MAX(r.c_date) AS max_c_date").
-		Where("parent.uri IN ? AND r.c_date <= ?", uris, cutoff).
-		Group("parent.uri").
-		Scan(&res).Error
+		err := r.db.WithContext(ctx).
+			Table("record_keys AS parent").
+			Joins("JOIN record_keys AS child ON child.parent_id = parent.id").
+			Joins("JOIN records r ON r.document_id = child.record_id").
+			Select("parent.uri AS uri, MAX(r.c_date) AS max_c_date").
+			Where("parent.uri IN ? AND r.c_date <= ?", group, cutoff).
+			Group("parent.uri").
+			Scan(&res).Error
 
-	if err != nil {
-		span.RecordError(err)
-		return nil, err
-	}
+		if err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
 
-	lookup := make(map[string]int64)
-	for _, row := range res {
-		lookup[row.URI] = row.MaxCDate.Unix() / 600
+		for _, row := range res {
+			lookup[row.URI] = layout.chunkOf(row.MaxCDate)
+		}
 	}
 	return lookup, nil
 }
 
-func (r *ChunklineRepository) LoadLocalBody(ctx context.Context, uri string, chunkID int64) ([]chunkline.BodyItem, error) {
+func (r *ChunklineRepository) LoadLocalBody(ctx context.Context, uri string, chunkID int64) ([]chunkline.BodyItem, bool, error) {
 	ctx, span := tracer.Start(ctx, "Repository.Chunkline.LoadLocalBody")
 	defer span.End()
 
-	chunkDate := time.Unix((chunkID+1)*600, 0)
-	prevChunkDate := time.Unix((chunkID-1)*600, 0)
-
-	parentRecordKey, err := GetRecordKeyByURI(ctx, r.db, uri)
+	parentRecordKey, layout, err := r.getLayout(ctx, uri)
 	if err != nil {
 		span.RecordError(err)
-		return nil, err
+		return nil, false, err
+	}
+
+	closed := layout.descendingClosed(chunkID)
+	cacheKey := r.bodyCacheKey("desc", uri, chunkID, closed)
+	var cached []chunkline.BodyItem
+	if database.GetJSON(r.mc, cacheKey, &cached) {
+		return cached, closed, nil
 	}
 
+	chunkDate := layout.chunkStart(chunkID + 1)
+	prevChunkDate := layout.chunkStart(chunkID - 1)
+
 	var members []models.RecordKey
 	err = r.db.WithContext(ctx).
 		Joins("JOIN records r ON r.document_id = record_keys.record_id").
 		Where("parent_id = ?", parentRecordKey.ID).
 		Where("r.c_date <= ?", chunkDate).
 		Order("r.c_date DESC").
-		Limit(defaultChunkSize).
+		Limit(layout.bodySize).
 		Preload("Record").
 		Preload("Record.Document").
 		Find(&members).Error
 	if err != nil {
 		span.RecordError(err)
-		return nil, err
+		return nil, false, err
 	}
 
 	if len(members) == 0 || members[len(members)-1].Record.CDate.After(prevChunkDate) {
@@ -142,31 +441,171 @@ func (r *ChunklineRepository) LoadLocalBody(ctx context.Context, uri string, chu
 			Preload("Record").
 			Preload("Record.Document").
 			Find(&members).Error
+		if err != nil {
+			span.RecordError(err)
+			return nil, false, err
+		}
+	}
+
+	items := toBodyItems(ctx, members)
+	database.SetJSON(r.mc, cacheKey, items, bodyExpiration(closed))
+	return items, closed, nil
+}
+
+// GetRemovedItems returns the IDs of the items removed from the collection at uri within
+// domain.RemovedItemsRetention. The list is cached until the next removal bumps the generation.
+func (r *ChunklineRepository) GetRemovedItems(ctx context.Context, uri string) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "Repository.Chunkline.GetRemovedItems")
+	defer span.End()
+
+	hash := fmt.Sprintf("%x", xxh3.HashString(uri))
+	gens := r.generations(generationKeys(hash))
+	cacheKey := fmt.Sprintf("chunkline:removed:%s:%s", hash, gens[0])
+	removed := []string{}
+	if database.GetJSON(r.mc, cacheKey, &removed) {
+		return removed, nil
+	}
+
+	err := r.db.WithContext(ctx).
+		Model(&models.RemovedItem{}).
+		Where("collection_uri = ? AND c_date > ?", uri, time.Now().Add(-domain.RemovedItemsRetention)).
+		Order("c_date ASC").
+		Pluck("item_id", &removed).Error
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	database.SetJSON(r.mc, cacheKey, removed, metadataTTL)
+	return removed, nil
+}
+
+// ListAllRemovedItems returns the IDs of every item ever removed from the collection at uri.
+// Static exports never rewrite the bodies of closed chunks, so their removals cannot age out.
+func (r *ChunklineRepository) ListAllRemovedItems(ctx context.Context, uri string) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "Repository.Chunkline.ListAllRemovedItems")
+	defer span.End()
+
+	removed := []string{}
+	err := r.db.WithContext(ctx).
+		Model(&models.RemovedItem{}).
+		Where("collection_uri = ?", uri).
+		Order("c_date ASC").
+		Pluck("item_id", &removed).Error
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	return removed, nil
+}
+
+// LookupLocalAscendingItrs returns, for each uri, the first chunk at or after chunkID which has members.
+// Timelines without such a chunk are omitted.
+func (r *ChunklineRepository) LookupLocalAscendingItrs(ctx context.Context, uris []string, chunkID int64) (map[string]int64, error) {
+	ctx, span := tracer.Start(ctx, "Repository.Chunkline.LookupLocalAscendingItrs")
+	defer span.End()
+
+	type TimelineRow struct {
+		URI      string    `gorm:"column:uri"`
+		MinCDate time.Time `gorm:"column:min_c_date"`
+	}
+
+	lookup := make(map[string]int64)
+	for layout, group := range r.groupByLayout(ctx, uris) {
+		var res []TimelineRow
+
+		cutoff := layout.chunkStart(chunkID) // ascending order
+
+		err := r.db.WithContext(ctx).
+			Table("record_keys AS parent").
+			Joins("JOIN record_keys AS child ON child.parent_id = parent.id").
+			Joins("JOIN records r ON r.document_id = child.record_id").
+			Select("parent.uri AS uri, MIN(r.c_date) AS min_c_date").
+			Where("parent.uri IN ? AND r.c_date >= ?", group, cutoff).
+			Group("parent.uri").
+			Scan(&res).Error
+
 		if err != nil {
 			span.RecordError(err)
 			return nil, err
 		}
+
+		for _, row := range res {
+			lookup[row.URI] = layout.chunkOf(row.MinCDate)
+		}
+	}
+	return lookup, nil
+}
+
+// LoadLocalAscendingBody returns the members from the start of chunkID on, oldest first.
+func (r *ChunklineRepository) LoadLocalAscendingBody(ctx context.Context, uri string, chunkID int64) ([]chunkline.BodyItem, bool, error) {
+	ctx, span := tracer.Start(ctx, "Repository.Chunkline.LoadLocalAscendingBody")
+	defer span.End()
+
+	parentRecordKey, layout, err := r.getLayout(ctx, uri)
+	if err != nil {
+		span.RecordError(err)
+		return nil, false, err
+	}
+
+	closed := layout.ascendingClosed(chunkID)
+	cacheKey := r.bodyCacheKey("asc", uri, chunkID, closed)
+	var cached []chunkline.BodyItem
+	if database.GetJSON(r.mc, cacheKey, &cached) {
+		return cached, closed, nil
 	}
 
+	chunkDate := layout.chunkStart(chunkID)
+	nextChunkDate := layout.chunkStart(chunkID + 2)
+
+	var members []models.RecordKey
+	err = r.db.WithContext(ctx).
+		Joins("JOIN records r ON r.document_id = record_keys.record_id").
+		Where("parent_id = ?", parentRecordKey.ID).
+		Where("r.c_date >= ?", chunkDate).
+		Order("r.c_date ASC").
+		Limit(layout.bodySize).
+		Preload("Record").
+		Preload("Record.Document").
+		Find(&members).Error
+	if err != nil {
+		span.RecordError(err)
+		return nil, false, err
+	}
+
+	if len(members) == 0 || members[len(members)-1].Record.CDate.Before(nextChunkDate) {
+		err = r.db.WithContext(ctx).
+			Joins("JOIN records r ON r.document_id = record_keys.record_id").
+			Where("parent_id = ?", parentRecordKey.ID).
+			Where("r.c_date >= ?", chunkDate).
+			Where("r.c_date < ?", nextChunkDate).
+			Order("r.c_date ASC").
+			Preload("Record").
+			Preload("Record.Document").
+			Find(&members).Error
+		if err != nil {
+			span.RecordError(err)
+			return nil, false, err
+		}
+	}
+
+	items := toBodyItems(ctx, members)
+	database.SetJSON(r.mc, cacheKey, items, bodyExpiration(closed))
+	return items, closed, nil
+}
+
+// toBodyItems converts collection members to chunk body items, following references.
+func toBodyItems(ctx context.Context, members []models.RecordKey) []chunkline.BodyItem {
+	span := trace.SpanFromContext(ctx)
+
 	bodyItems := make([]chunkline.BodyItem, 0, len(members))
 
 	for _, member := range members {
 
-		href := member.URI
-		contentType := "application/concrnt.document+json"
-		if member.Record.Schema == schemas.ReferenceURL {
-			var itemURLValue concrnt.Document[schemas.Reference]
-			err = json.Unmarshal([]byte(member.Record.Document.Document), &itemURLValue)
-			if err == nil {
-				if itemURLValue.Value.Href != "" {
-					href = itemURLValue.Value.Href
-				}
-				if itemURLValue.Value.ContentType != "" {
-					contentType = itemURLValue.Value.ContentType
-				}
-			} else {
-				span.RecordError(err)
-			}
+		href, contentType, err := memberHref(member)
+		if err != nil {
+			span.RecordError(err)
 		}
 
 		item := chunkline.BodyItem{
@@ -177,5 +616,86 @@ func (r *ChunklineRepository) LoadLocalBody(ctx context.Context, uri string, chu
 		bodyItems = append(bodyItems, item)
 	}
 
-	return bodyItems, nil
+	return bodyItems
+}
+
+// memberHref returns what a collection member points to. This is also the ID of its body item.
+// The member's Record.Document must be loaded.
+func memberHref(member models.RecordKey) (string, string, error) {
+	return documentHref(member.URI, member.Record.Schema, member.Record.Document.Document)
+}
+
+// documentHref returns what the record at uri points to as a collection member, and its content type.
+// References point to their href, other records to themselves.
+func documentHref(uri, schema, document string) (string, string, error) {
+	href := uri
+	contentType := "application/concrnt.document+json"
+	if schema == schemas.ReferenceURL {
+		var itemURLValue concrnt.Document[schemas.Reference]
+		err := json.Unmarshal([]byte(document), &itemURLValue)
+		if err != nil {
+			return href, contentType, err
+		}
+		if itemURLValue.Value.Href != "" {
+			href = itemURLValue.Value.Href
+		}
+		if itemURLValue.Value.ContentType != "" {
+			contentType = itemURLValue.Value.ContentType
+		}
+	}
+	return href, contentType, nil
+}
+
+// ListTimelines returns up to limit URIs of collections whose key comes after cursor, with the cursor of the next page.
+func (r *ChunklineRepository) ListTimelines(ctx context.Context, cursor int64, limit int) ([]string, int64, error) {
+	ctx, span := tracer.Start(ctx, "Repository.Chunkline.ListTimelines")
+	defer span.End()
+
+	var rks []models.RecordKey
+	err := r.db.WithContext(ctx).
+		Select("id", "uri").
+		Where("EXISTS (SELECT 1 FROM record_keys m WHERE m.parent_id = record_keys.id)").
+		Where("id > ?", cursor).
+		Order("id ASC").
+		Limit(limit).
+		Find(&rks).Error
+	if err != nil {
+		span.RecordError(err)
+		return nil, cursor, err
+	}
+
+	uris := make([]string, 0, len(rks))
+	for _, rk := range rks {
+		uris = append(uris, rk.URI)
+		cursor = rk.ID
+	}
+
+	return uris, cursor, nil
+}
+
+// ListLocalChunks returns the IDs of the chunks of uri which have members, in ascending order.
+func (r *ChunklineRepository) ListLocalChunks(ctx context.Context, uri string) ([]int64, error) {
+	ctx, span := tracer.Start(ctx, "Repository.Chunkline.ListLocalChunks")
+	defer span.End()
+
+	recordKey, layout, err := r.getLayout(ctx, uri)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	chunks := []int64{}
+	err = r.db.WithContext(ctx).
+		Model(&models.RecordKey{}).
+		Joins("JOIN records r ON r.document_id = record_keys.record_id").
+		Where("record_keys.parent_id = ?", recordKey.ID).
+		Distinct("FLOOR(EXTRACT(EPOCH FROM r.c_date) / ?)::bigint AS chunk", layout.chunkSize).
+		Order("chunk ASC").
+		Scan(&chunks).Error
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	return chunks, nil
 }
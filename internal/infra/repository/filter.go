@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/totegamma/concrnt-playground/internal/domain"
+	"github.com/totegamma/concrnt-playground/policy"
+)
+
+// compileFilter compiles a query filter checked by domain.ParseQueryFilter into a condition on
+// the value column of records. Field tests become JSONB containment so that the GIN index is used.
+func compileFilter(expr policy.Expr) (string, []any, error) {
+	switch expr.Operator {
+	case "And", "Or":
+		conds := make([]string, 0, len(expr.Args))
+		var args []any
+		for _, arg := range expr.Args {
+			cond, condArgs, err := compileFilter(arg)
+			if err != nil {
+				return "", nil, err
+			}
+			conds = append(conds, cond)
+			args = append(args, condArgs...)
+		}
+		return "(" + strings.Join(conds, " "+strings.ToUpper(expr.Operator)+" ") + ")", args, nil
+	case "Not":
+		if len(expr.Args) != 1 {
+			return "", nil, fmt.Errorf("bad argument length for Not")
+		}
+		cond, args, err := compileFilter(expr.Args[0])
+		if err != nil {
+			return "", nil, err
+		}
+		return "(NOT " + cond + ")", args, nil
+	case "Eq":
+		if len(expr.Args) == 2 {
+			if path, ok := domain.QueryFilterPath(expr.Args[0]); ok {
+				return containsValue(path, expr.Args[1].Const)
+			}
+		}
+	case "Contains":
+		if len(expr.Args) == 2 {
+			if path, ok := domain.QueryFilterPath(expr.Args[0]); ok {
+				return containsValue(path, []any{expr.Args[1].Const})
+			}
+			if path, ok := domain.QueryFilterPath(expr.Args[1]); ok {
+				list, _ := expr.Args[0].Const.([]any)
+				conds := make([]string, 0, len(list))
+				var args []any
+				for _, item := range list {
+					cond, condArgs, err := containsValue(path, item)
+					if err != nil {
+						return "", nil, err
+					}
+					conds = append(conds, cond)
+					args = append(args, condArgs...)
+				}
+				return "(" + strings.Join(conds, " OR ") + ")", args, nil
+			}
+		}
+	}
+	return "", nil, fmt.Errorf("unsupported filter: %s", expr.Operator)
+}
+
+// containsValue is the condition that the value has value at path.
+func containsValue(path []string, value any) (string, []any, error) {
+	for i := len(path) - 1; i >= 0; i-- {
+		value = map[string]any{path[i]: value}
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", nil, err
+	}
+	return "r.value @> CAST(? AS jsonb)", []any{string(data)}, nil
+}
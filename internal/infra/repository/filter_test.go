@@ -0,0 +1,46 @@
+package repository
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/totegamma/concrnt-playground/internal/domain"
+)
+
+func TestCompileFilter(t *testing.T) {
+	filter, err := domain.ParseQueryFilter(`{"op":"And","args":[
+		{"op":"Contains","args":[{"op":"Load","args":[{"const":"value.tags"}]},{"const":"go"}]},
+		{"op":"Not","args":[{"op":"Contains","args":[{"const":["ja","en"]},{"op":"Load","args":[{"const":"value.meta.lang"}]}]}]}
+	]}`)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	cond, args, err := compileFilter(filter)
+	if err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+
+	expectedCond := "(r.value @> CAST(? AS jsonb) AND (NOT (r.value @> CAST(? AS jsonb) OR r.value @> CAST(? AS jsonb))))"
+	if cond != expectedCond {
+		t.Fatalf("unexpected condition:\n%s\n%s", cond, expectedCond)
+	}
+	expectedArgs := []any{`{"tags":["go"]}`, `{"meta":{"lang":"ja"}}`, `{"meta":{"lang":"en"}}`}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Fatalf("unexpected args: %v", args)
+	}
+}
+
+func TestParseQueryFilterRejectsUnsafe(t *testing.T) {
+	for _, s := range []string{
+		`{"op":"Eq","args":[{"op":"Load","args":[{"const":"requester"}]},{"const":"x"}]}`,
+		`{"op":"Eq","args":[{"op":"Load","args":[{"const":"value.a"}]},{"const":{"b":1}}]}`,
+		`{"op":"Contains","args":[{"const":[]},{"op":"Load","args":[{"const":"value.a"}]}]}`,
+		`{"op":"Or","args":[]}`,
+		`{"op":"Load","args":[{"const":"value.a"}]}`,
+	} {
+		if _, err := domain.ParseQueryFilter(s); err == nil {
+			t.Errorf("expected %s to be rejected", s)
+		}
+	}
+}
@@ -0,0 +1,680 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/concrnt/chunkline"
+
+	"github.com/totegamma/concrnt-playground"
+	"github.com/totegamma/concrnt-playground/internal/domain"
+	"github.com/totegamma/concrnt-playground/internal/utils"
+	"github.com/totegamma/concrnt-playground/policy"
+	"github.com/totegamma/concrnt-playground/schemas"
+	"github.com/zeebo/xxh3"
+)
+
+const (
+	// objectRetries is how often a conditional write is retried after losing to a concurrent one
+	objectRetries = 10
+	// objectFillParallelism is the number of iterators written at once when a timeline skips chunks
+	objectFillParallelism = 8
+)
+
+var errObjectUnsupported = errors.New("not supported in write-on-commit mode")
+
+// ObjectStore holds the files of the static layout. Get returns domain.ErrNotFound for missing files,
+// PutIfVersion returns domain.ErrConflict when the file changed since GetVersion.
+type ObjectStore interface {
+	Put(ctx context.Context, path, contentType string, body []byte) error
+	Get(ctx context.Context, path string) ([]byte, error)
+	Delete(ctx context.Context, path string) error
+	GetVersion(ctx context.Context, path string) ([]byte, string, error)
+	PutIfVersion(ctx context.Context, path, contentType string, body []byte, version string) error
+}
+
+// ObjectRecordRepository writes records straight into the static layout of an object store.
+// It backs the write-on-commit mode, which runs without Postgres and Redis.
+//
+// Timelines are kept up to date on every commit: the item goes into the body of its chunk,
+// iterators are written up to that chunk and the manifest's LastChunk moves along, so
+// readers see new items immediately. Chunk bodies hold the items of their chunk only.
+// Queries and associations need the database and are not supported.
+type ObjectRecordRepository struct {
+	store  ObjectStore
+	config ChunklineConfig
+}
+
+func NewObjectRecordRepository(store ObjectStore, config ChunklineConfig) *ObjectRecordRepository {
+	return &ObjectRecordRepository{
+		store:  store,
+		config: config.withDefaults(),
+	}
+}
+
+func (r *ObjectRecordRepository) CreateRecord(ctx context.Context, sd concrnt.SignedDocument) error {
+	ctx, span := tracer.Start(ctx, "Repository.ObjectRecord.CreateRecord")
+	defer span.End()
+
+	var doc concrnt.Document[any]
+	err := json.Unmarshal([]byte(sd.Document), &doc)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	documentID, owner, uri := recordIdentity(sd.Document, doc)
+	_, key, err := concrnt.ParseCCURI(uri)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	resourcePath, err := domain.StaticResourcePath(owner, key)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	_, err = r.store.Get(ctx, resourcePath)
+	created := errors.Is(err, domain.ErrNotFound)
+	if err != nil && !created {
+		span.RecordError(err)
+		return err
+	}
+
+	body, err := json.Marshal(sd)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	err = r.store.Put(ctx, resourcePath, "application/json", body)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	// Distribute
+	if doc.MemberOf != nil {
+		for _, memberOfURI := range *doc.MemberOf {
+			sd, err := referenceDocument(memberOfURI, owner, uri, documentID)
+			if err != nil {
+				fmt.Printf("Error parsing memberOf URI: %v\n", err)
+				span.RecordError(err)
+				continue
+			}
+			err = r.CreateRecord(ctx, sd)
+			if err != nil {
+				fmt.Printf("Error creating memberOf item: %v\n", err)
+				continue
+			}
+		}
+	}
+
+	// the record may be a collection itself
+	err = r.updateMetadata(ctx, owner, key, sd.Document)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	collectionURI, err := url.JoinPath(uri, "..")
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	collectionOwner, collectionKey, err := concrnt.ParseCCURI(collectionURI)
+	if err != nil || collectionKey == "" {
+		return nil
+	}
+
+	href, contentType, err := documentHref(uri, doc.Schema, sd.Document)
+	if err != nil {
+		span.RecordError(err)
+	}
+
+	err = r.appendItem(ctx, collectionOwner, collectionKey, chunkline.BodyItem{
+		Timestamp:   time.Now(),
+		Href:        href,
+		ContentType: contentType,
+	}, created)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *ObjectRecordRepository) CreateAssociation(ctx context.Context, sd concrnt.SignedDocument) error {
+	return errObjectUnsupported
+}
+
+func (r *ObjectRecordRepository) CreateRemoteAssociation(ctx context.Context, sd concrnt.SignedDocument) error {
+	return errObjectUnsupported
+}
+
+func (r *ObjectRecordRepository) GetSignedDocuments(ctx context.Context, uris []string) (map[string]concrnt.SignedDocument, error) {
+	return nil, errObjectUnsupported
+}
+
+func (r *ObjectRecordRepository) GetAssociationTarget(ctx context.Context, uri string) (string, error) {
+	return "", errObjectUnsupported
+}
+
+func (r *ObjectRecordRepository) CreateAck(ctx context.Context, sd concrnt.SignedDocument) error {
+	return errObjectUnsupported
+}
+
+// Delete removes the record and adds it to the removed items of the collections it was in.
+// The target must be given by its record URI. References created through memberOf stay
+// in place, readers drop them through the removed items.
+func (r *ObjectRecordRepository) Delete(ctx context.Context, sd concrnt.SignedDocument) error {
+	ctx, span := tracer.Start(ctx, "Repository.ObjectRecord.Delete")
+	defer span.End()
+
+	var doc concrnt.Document[schemas.Delete]
+	err := json.Unmarshal([]byte(sd.Document), &doc)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	uri := string(doc.Value)
+
+	owner, key, err := concrnt.ParseCCURI(uri)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	resourcePath, err := domain.StaticResourcePath(owner, key)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	target, err := r.GetSignedDocument(ctx, uri)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	var targetDoc concrnt.Document[any]
+	err = json.Unmarshal([]byte(target.Document), &targetDoc)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	collectionURI, err := url.JoinPath(uri, "..")
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	collectionOwner, collectionKey, err := concrnt.ParseCCURI(collectionURI)
+	if err == nil && collectionKey != "" {
+		itemID, _, err := documentHref(uri, targetDoc.Schema, target.Document)
+		if err != nil {
+			span.RecordError(err)
+		}
+		err = r.removeItem(ctx, collectionOwner, collectionKey, itemID)
+		if err != nil {
+			span.RecordError(err)
+			return err
+		}
+	}
+
+	if targetDoc.MemberOf != nil {
+		for _, memberOfURI := range *targetDoc.MemberOf {
+			memberOwner, memberKey, err := concrnt.ParseCCURI(memberOfURI)
+			if err != nil {
+				span.RecordError(err)
+				continue
+			}
+			err = r.removeItem(ctx, memberOwner, memberKey, uri)
+			if err != nil {
+				span.RecordError(err)
+				return err
+			}
+		}
+	}
+
+	err = r.store.Delete(ctx, resourcePath)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *ObjectRecordRepository) GetDocument(ctx context.Context, uri string) (*concrnt.Document[any], error) {
+	ctx, span := tracer.Start(ctx, "Repository.ObjectRecord.GetDocument")
+	defer span.End()
+
+	sd, err := r.GetSignedDocument(ctx, uri)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	var doc concrnt.Document[any]
+	err = json.Unmarshal([]byte(sd.Document), &doc)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	return &doc, nil
+}
+
+func (r *ObjectRecordRepository) GetSignedDocument(ctx context.Context, uri string) (*concrnt.SignedDocument, error) {
+	ctx, span := tracer.Start(ctx, "Repository.ObjectRecord.GetSignedDocument")
+	defer span.End()
+
+	owner, key, err := concrnt.ParseCCURI(uri)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	path, err := domain.StaticResourcePath(owner, key)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	body, err := r.store.Get(ctx, path)
+	if errors.Is(err, domain.ErrNotFound) {
+		return nil, domain.NotFoundError{Resource: "commit"}
+	}
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	var sd concrnt.SignedDocument
+	err = json.Unmarshal(body, &sd)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	return &sd, nil
+}
+
+func (r *ObjectRecordRepository) GetAssociatedRecords(ctx context.Context, targetURI, schema, variant, author string, cursor *domain.QueryCursor, limit int, order string) ([]concrnt.SignedDocument, *domain.QueryCursor, error) {
+	return nil, nil, errObjectUnsupported
+}
+
+func (r *ObjectRecordRepository) GetAssociatedRecordCountsBySchema(ctx context.Context, targetURI string) (map[string]int64, error) {
+	return nil, errObjectUnsupported
+}
+
+func (r *ObjectRecordRepository) GetAssociatedRecordCountsByVariant(ctx context.Context, targetURI, schema string) (*utils.OrderedKVMap[int64], error) {
+	return nil, errObjectUnsupported
+}
+
+func (r *ObjectRecordRepository) Query(ctx context.Context, prefix, schema string, since, until *time.Time, filter *policy.Expr, cursor *domain.QueryCursor, limit int, order string) ([]concrnt.QueryItem, *domain.QueryCursor, error) {
+	return nil, nil, errObjectUnsupported
+}
+
+func (r *ObjectRecordRepository) ListChildren(ctx context.Context, uri string, depth int, cursor string, limit int) (*concrnt.ChildrenResult, error) {
+	return nil, errObjectUnsupported
+}
+
+func (r *ObjectRecordRepository) ListURIs(ctx context.Context, cursor int64, limit int) ([]string, int64, error) {
+	return nil, cursor, errObjectUnsupported
+}
+
+// update rewrites the file at path with fn, retrying when a concurrent write got in between.
+// fn receives nil for a missing file and may run more than once.
+func (r *ObjectRecordRepository) update(ctx context.Context, path string, fn func(body []byte) ([]byte, error)) error {
+	for range objectRetries {
+		body, version, err := r.store.GetVersion(ctx, path)
+		if err != nil && !errors.Is(err, domain.ErrNotFound) {
+			return err
+		}
+
+		updated, err := fn(body)
+		if err != nil {
+			return err
+		}
+
+		err = r.store.PutIfVersion(ctx, path, "application/json", updated, version)
+		if !errors.Is(err, domain.ErrConflict) {
+			return err
+		}
+	}
+	return domain.ConflictError{Resource: path}
+}
+
+// newManifest describes the timeline of the collection owner/key before its first item,
+// with the layout and metadata of the collection document if there is one.
+func (r *ObjectRecordRepository) newManifest(ctx context.Context, owner, key string) (concrnt.ChunklineManifest, error) {
+	layout := r.config.layout()
+	var metadata concrnt.ChunklineMetadata
+
+	collection, err := r.GetSignedDocument(ctx, concrnt.ComposeCCURI(owner, key))
+	if err != nil && !errors.Is(err, domain.ErrNotFound) {
+		return concrnt.ChunklineManifest{}, err
+	}
+	if collection != nil {
+		layout = layout.override(collection.Document)
+		metadata, err = documentMetadata(collection.Document)
+		if err != nil {
+			return concrnt.ChunklineManifest{}, err
+		}
+	}
+
+	base, err := domain.StaticChunklinePath(owner, key)
+	if err != nil {
+		return concrnt.ChunklineManifest{}, err
+	}
+	return concrnt.ChunklineManifest{
+		Manifest: chunkline.Manifest{
+			Version:   "1.0",
+			ChunkSize: layout.chunkSize,
+			Descending: &chunkline.Endpoint{
+				Iterator: base + "/{chunk}.itr",
+				Body:     base + "/{chunk}.body.json",
+			},
+			Metadata: metadata,
+		},
+		Removed: base + "/removed.json",
+	}, nil
+}
+
+func (r *ObjectRecordRepository) getManifest(ctx context.Context, owner, key string) (*concrnt.ChunklineManifest, concrnt.ChunklineMetadata, error) {
+	base, err := domain.StaticChunklinePath(owner, key)
+	if err != nil {
+		return nil, concrnt.ChunklineMetadata{}, err
+	}
+
+	body, err := r.store.Get(ctx, base+"/manifest.json")
+	if errors.Is(err, domain.ErrNotFound) {
+		return nil, concrnt.ChunklineMetadata{}, nil
+	}
+	if err != nil {
+		return nil, concrnt.ChunklineMetadata{}, err
+	}
+	return decodeManifest(body)
+}
+
+// decodeManifest also returns the metadata, which decodes into a map otherwise.
+func decodeManifest(body []byte) (*concrnt.ChunklineManifest, concrnt.ChunklineMetadata, error) {
+	var manifest struct {
+		concrnt.ChunklineManifest
+		Metadata concrnt.ChunklineMetadata `json:"metadata"`
+	}
+	err := json.Unmarshal(body, &manifest)
+	if err != nil {
+		return nil, concrnt.ChunklineMetadata{}, err
+	}
+	return &manifest.ChunklineManifest, manifest.Metadata, nil
+}
+
+// appendItem adds item to the timeline of the collection owner/key. created tells whether
+// the item is new to the collection rather than an update of an existing one, which is
+// moved out of the chunk it was in before.
+func (r *ObjectRecordRepository) appendItem(ctx context.Context, owner, key string, item chunkline.BodyItem, created bool) error {
+	ctx, span := tracer.Start(ctx, "Repository.ObjectRecord.appendItem")
+	defer span.End()
+
+	base, err := domain.StaticChunklinePath(owner, key)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	manifest, _, err := r.getManifest(ctx, owner, key)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	if manifest == nil {
+		initial, err := r.newManifest(ctx, owner, key)
+		if err != nil {
+			span.RecordError(err)
+			return err
+		}
+		manifest = &initial
+
+		err = r.store.PutIfVersion(ctx, base+"/removed.json", "application/json", []byte("[]"), "")
+		if err != nil && !errors.Is(err, domain.ErrConflict) {
+			span.RecordError(err)
+			return err
+		}
+	}
+	chunkID := manifest.Time2Chunk(item.Timestamp)
+
+	err = r.update(ctx, base+"/"+strconv.FormatInt(chunkID, 10)+".body.json", func(body []byte) ([]byte, error) {
+		items := []chunkline.BodyItem{}
+		if body != nil {
+			err := json.Unmarshal(body, &items)
+			if err != nil {
+				return nil, err
+			}
+		}
+		items = slices.DeleteFunc(items, func(i chunkline.BodyItem) bool { return i.Href == item.Href })
+		items = append(items, item)
+		sort.SliceStable(items, func(i, j int) bool { return items[i].Timestamp.After(items[j].Timestamp) })
+		return json.Marshal(items)
+	})
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	// an updated item leaves its previous chunk only once it is in the new one, so that readers never miss it
+	refPath := base + "/items/" + strconv.FormatUint(xxh3.HashString(item.Href), 16) + ".chunk"
+	if !created {
+		body, err := r.store.Get(ctx, refPath)
+		if err != nil && !errors.Is(err, domain.ErrNotFound) {
+			span.RecordError(err)
+			return err
+		}
+		if err == nil {
+			previous, err := strconv.ParseInt(string(body), 10, 64)
+			if err == nil && previous != chunkID {
+				err = r.removeFromChunk(ctx, base, previous, item.Href)
+				if err != nil {
+					span.RecordError(err)
+					return err
+				}
+			}
+		}
+	}
+	err = r.store.Put(ctx, refPath, "text/plain", []byte(strconv.FormatInt(chunkID, 10)))
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	err = r.update(ctx, base+"/manifest.json", func(body []byte) ([]byte, error) {
+		current := *manifest
+		metadata, _ := manifest.Metadata.(concrnt.ChunklineMetadata)
+		if body == nil {
+			current.FirstChunk = chunkID
+			current.LastChunk = chunkID - 1
+		} else {
+			decoded, decodedMetadata, err := decodeManifest(body)
+			if err != nil {
+				return nil, err
+			}
+			current = *decoded
+			metadata = decodedMetadata
+		}
+
+		if chunkID > current.LastChunk {
+			// chunks skipped since the last item point back to it
+			previous := current.LastChunk
+			if previous < current.FirstChunk {
+				previous = 0
+			}
+			err := r.fillIterators(ctx, base, max(current.LastChunk+1, current.FirstChunk), chunkID, previous)
+			if err != nil {
+				return nil, err
+			}
+			current.LastChunk = chunkID
+		}
+
+		if created {
+			metadata.MemberCount++
+		}
+		lastUpdate := item.Timestamp
+		metadata.LastUpdate = &lastUpdate
+		current.Metadata = metadata
+
+		return json.Marshal(current)
+	})
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	return nil
+}
+
+// removeFromChunk drops the item with href from the body of chunkID.
+func (r *ObjectRecordRepository) removeFromChunk(ctx context.Context, base string, chunkID int64, href string) error {
+	return r.update(ctx, base+"/"+strconv.FormatInt(chunkID, 10)+".body.json", func(body []byte) ([]byte, error) {
+		items := []chunkline.BodyItem{}
+		if body != nil {
+			err := json.Unmarshal(body, &items)
+			if err != nil {
+				return nil, err
+			}
+		}
+		items = slices.DeleteFunc(items, func(i chunkline.BodyItem) bool { return i.Href == href })
+		return json.Marshal(items)
+	})
+}
+
+// fillIterators writes the iterators of the chunks from..to. The iterator of to points to itself,
+// the others to previous.
+func (r *ObjectRecordRepository) fillIterators(ctx context.Context, base string, from, to, previous int64) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, objectFillParallelism)
+	)
+
+	for chunkID := from; chunkID <= to; chunkID++ {
+		itr := previous
+		if chunkID == to {
+			itr = to
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := r.store.Put(ctx, base+"/"+strconv.FormatInt(chunkID, 10)+".itr", "text/plain", []byte(strconv.FormatInt(itr, 10)))
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// removeItem adds itemID to the removed items of the collection owner/key, if it has a timeline.
+func (r *ObjectRecordRepository) removeItem(ctx context.Context, owner, key, itemID string) error {
+	ctx, span := tracer.Start(ctx, "Repository.ObjectRecord.removeItem")
+	defer span.End()
+
+	base, err := domain.StaticChunklinePath(owner, key)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	manifest, _, err := r.getManifest(ctx, owner, key)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	if manifest == nil {
+		return nil
+	}
+
+	err = r.update(ctx, base+"/removed.json", func(body []byte) ([]byte, error) {
+		removed := []string{}
+		if body != nil {
+			err := json.Unmarshal(body, &removed)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !slices.Contains(removed, itemID) {
+			removed = append(removed, itemID)
+		}
+		return json.Marshal(removed)
+	})
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	err = r.update(ctx, base+"/manifest.json", func(body []byte) ([]byte, error) {
+		current, metadata, err := decodeManifest(body)
+		if err != nil {
+			return nil, err
+		}
+		metadata.MemberCount = max(metadata.MemberCount-1, 0)
+		current.Metadata = metadata
+		return json.Marshal(current)
+	})
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	return nil
+}
+
+// updateMetadata refreshes the metadata in the manifest of the collection owner/key from its
+// new document, if the collection already has a timeline.
+func (r *ObjectRecordRepository) updateMetadata(ctx context.Context, owner, key, document string) error {
+	manifest, _, err := r.getManifest(ctx, owner, key)
+	if err != nil || manifest == nil {
+		return err
+	}
+
+	described, err := documentMetadata(document)
+	if err != nil {
+		return err
+	}
+
+	base, err := domain.StaticChunklinePath(owner, key)
+	if err != nil {
+		return err
+	}
+
+	return r.update(ctx, base+"/manifest.json", func(body []byte) ([]byte, error) {
+		current, metadata, err := decodeManifest(body)
+		if err != nil {
+			return nil, err
+		}
+		described.MemberCount = metadata.MemberCount
+		described.LastUpdate = metadata.LastUpdate
+		current.Metadata = described
+		return json.Marshal(current)
+	})
+}
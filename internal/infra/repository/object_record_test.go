@@ -0,0 +1,142 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/concrnt/chunkline"
+
+	"github.com/totegamma/concrnt-playground/internal/domain"
+	"github.com/totegamma/concrnt-playground/internal/infra/storage"
+)
+
+const testOwner = "cc1testowner"
+
+func readChunk(t *testing.T, store ObjectStore, base string, chunkID int64) []chunkline.BodyItem {
+	t.Helper()
+	body, err := store.Get(context.Background(), base+"/"+strconv.FormatInt(chunkID, 10)+".body.json")
+	if err != nil {
+		t.Fatalf("failed to read chunk %d: %v", chunkID, err)
+	}
+	var items []chunkline.BodyItem
+	err = json.Unmarshal(body, &items)
+	if err != nil {
+		t.Fatalf("failed to decode chunk %d: %v", chunkID, err)
+	}
+	return items
+}
+
+// Concurrent appends race on the chunk bodies and the manifest, and must all survive.
+func TestObjectAppendItemConcurrent(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewDirectory(t.TempDir())
+	repo := NewObjectRecordRepository(store, ChunklineConfig{ChunkSize: time.Minute})
+
+	const (
+		writers = 4
+		items   = 6
+	)
+	start := time.Unix(1_700_000_000, 0)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*items)
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range items {
+				err := repo.appendItem(ctx, testOwner, "posts", chunkline.BodyItem{
+					Timestamp: start.Add(time.Duration(i) * 45 * time.Second),
+					Href:      fmt.Sprintf("/resource/%s/posts/%d-%d.json", testOwner, w, i),
+				}, true)
+				if err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("append failed: %v", err)
+	}
+
+	base, _ := domain.StaticChunklinePath(testOwner, "posts")
+	manifest, metadata, err := repo.getManifest(ctx, testOwner, "posts")
+	if err != nil || manifest == nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	if metadata.MemberCount != writers*items {
+		t.Fatalf("unexpected member count: %d", metadata.MemberCount)
+	}
+
+	first := manifest.Time2Chunk(start)
+	last := manifest.Time2Chunk(start.Add(time.Duration(items-1) * 45 * time.Second))
+	if manifest.FirstChunk != first || manifest.LastChunk != last {
+		t.Fatalf("unexpected chunk range: %d..%d, expected %d..%d", manifest.FirstChunk, manifest.LastChunk, first, last)
+	}
+
+	seen := 0
+	for chunkID := first; chunkID <= last; chunkID++ {
+		_, err := store.Get(ctx, base+"/"+strconv.FormatInt(chunkID, 10)+".itr")
+		if err != nil {
+			t.Fatalf("missing iterator of chunk %d: %v", chunkID, err)
+		}
+		seen += len(readChunk(t, store, base, chunkID))
+	}
+	if seen != writers*items {
+		t.Fatalf("unexpected number of items: %d", seen)
+	}
+}
+
+// An updated item moves to the chunk of its new timestamp.
+func TestObjectAppendItemMoves(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewDirectory(t.TempDir())
+	repo := NewObjectRecordRepository(store, ChunklineConfig{ChunkSize: time.Minute})
+
+	start := time.Unix(1_700_000_000, 0)
+	href := "/resource/" + testOwner + "/posts/a.json"
+
+	err := repo.appendItem(ctx, testOwner, "posts", chunkline.BodyItem{Timestamp: start, Href: href}, true)
+	if err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+	err = repo.appendItem(ctx, testOwner, "posts", chunkline.BodyItem{Timestamp: start.Add(5 * time.Minute), Href: href}, false)
+	if err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+
+	base, _ := domain.StaticChunklinePath(testOwner, "posts")
+	manifest, metadata, err := repo.getManifest(ctx, testOwner, "posts")
+	if err != nil || manifest == nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	if metadata.MemberCount != 1 {
+		t.Fatalf("unexpected member count: %d", metadata.MemberCount)
+	}
+	if items := readChunk(t, store, base, manifest.FirstChunk); len(items) != 0 {
+		t.Fatalf("item left in its previous chunk: %v", items)
+	}
+	if items := readChunk(t, store, base, manifest.LastChunk); len(items) != 1 || items[0].Href != href {
+		t.Fatalf("item missing from its new chunk: %v", items)
+	}
+}
+
+func TestStaticPathsRejectTraversal(t *testing.T) {
+	for _, key := range []string{"..", "../cc1other/posts", "posts/../../resource", "posts//a", "posts/."} {
+		_, err := domain.StaticChunklinePath(testOwner, key)
+		if err == nil {
+			t.Fatalf("accepted key %q", key)
+		}
+	}
+	_, err := domain.StaticResourcePath("..", "posts")
+	if err == nil {
+		t.Fatalf("accepted owner ..")
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/zeebo/xxh3"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 
@@ -20,18 +19,26 @@ import (
 	"github.com/totegamma/concrnt-playground/internal/infra/database/models"
 	"github.com/totegamma/concrnt-playground/internal/service"
 	"github.com/totegamma/concrnt-playground/internal/utils"
+	"github.com/totegamma/concrnt-playground/policy"
 	"github.com/totegamma/concrnt-playground/schemas"
 )
 
 type RecordRepository struct {
 	db     *gorm.DB
 	signal *service.SignalService
+	search *SearchRepository
 }
 
 func NewRecordRepository(db *gorm.DB, signal *service.SignalService) *RecordRepository {
 	return &RecordRepository{db: db, signal: signal}
 }
 
+// SetSearch makes created records searchable through search.
+// It must be called before records are created.
+func (r *RecordRepository) SetSearch(search *SearchRepository) {
+	r.search = search
+}
+
 func (r *RecordRepository) CreateRecord(ctx context.Context, sd concrnt.SignedDocument) error {
 	ctx, span := tracer.Start(ctx, "Repository.Record.CreateRecord")
 	defer span.End()
@@ -43,25 +50,23 @@ func (r *RecordRepository) CreateRecord(ctx context.Context, sd concrnt.SignedDo
 		return err
 	}
 
-	hash := concrnt.GetHash([]byte(sd.Document))
-	hash10 := [10]byte{}
-	copy(hash10[:], hash[:10])
-	createdAt := doc.CreatedAt
-	documentID := cdid.New(hash10, createdAt).String()
+	documentID, owner, uri := recordIdentity(sd.Document, doc)
 
-	owner := doc.Author
-	if doc.Owner != nil {
-		owner = *doc.Owner
+	value, err := json.Marshal(doc.Value)
+	if err != nil {
+		span.RecordError(err)
+		return err
 	}
 
 	record := models.Record{
 		DocumentID: documentID,
 		Owner:      owner,
 		Schema:     doc.Schema,
+		Value:      string(value),
 		CDate:      time.Now(),
 	}
 
-	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+	err = r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 
 		proof, err := json.Marshal(sd.Proof)
 		if err != nil {
@@ -109,15 +114,16 @@ func (r *RecordRepository) CreateRecord(ctx context.Context, sd concrnt.SignedDo
 			return err
 		}
 
-		key := doc.Key
-		if strings.Contains(key, "{cdid}") {
-			key = strings.ReplaceAll(key, "{cdid}", documentID)
+		if r.search != nil {
+			if err := r.search.index(ctx, tx, documentID, doc); err != nil {
+				span.RecordError(err)
+				return err
+			}
 		}
-		uri := concrnt.ComposeCCURI(owner, key)
 
 		var oldRecordKey models.RecordKey
 		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
-			Where("uri = ?", concrnt.ComposeCCURI(owner, key)).
+			Where("uri = ?", uri).
 			Take(&oldRecordKey).Error
 		if err != nil && err != gorm.ErrRecordNotFound {
 			span.RecordError(err)
@@ -125,7 +131,7 @@ func (r *RecordRepository) CreateRecord(ctx context.Context, sd concrnt.SignedDo
 		}
 
 		// ParentのRecordKeyを探す
-		parentRK, err := getOrCreateParentRecordKey(ctx, tx, concrnt.ComposeCCURI(owner, key))
+		parentRK, err := getOrCreateParentRecordKey(ctx, tx, uri)
 		if err != nil {
 			span.RecordError(err)
 			return err
@@ -169,36 +175,12 @@ func (r *RecordRepository) CreateRecord(ctx context.Context, sd concrnt.SignedDo
 		// Distribute
 		if doc.MemberOf != nil {
 			for _, memberOfURI := range *doc.MemberOf {
-				memberOwner, key, err := concrnt.ParseCCURI(memberOfURI)
+				sd, err := referenceDocument(memberOfURI, owner, uri, documentID)
 				if err != nil {
 					fmt.Printf("Error parsing memberOf URI: %v\n", err)
 					span.RecordError(err)
 					continue
 				}
-				path := path.Join(key, documentID)
-
-				document := concrnt.Document[schemas.Reference]{
-					Key: path,
-					Value: schemas.Reference{
-						Href: uri,
-					},
-					Author:    owner,
-					Owner:     &memberOwner,
-					Schema:    schemas.ReferenceURL,
-					CreatedAt: time.Now(),
-				}
-				docBytes, err := json.Marshal(document)
-				if err != nil {
-					span.RecordError(err)
-					return err
-				}
-				sd := concrnt.SignedDocument{
-					Document: string(docBytes),
-					Proof: concrnt.Proof{
-						Type: "document-reference",
-						Href: &uri,
-					},
-				}
 				err = r.CreateRecord(ctx, sd)
 				if err != nil {
 					fmt.Printf("Error creating memberOf item: %v\n", err)
@@ -207,24 +189,39 @@ func (r *RecordRepository) CreateRecord(ctx context.Context, sd concrnt.SignedDo
 			}
 		}
 
-		// signal
-		err = r.signal.Publish(ctx, uri, concrnt.Event{
-			Type: "created",
-			URI:  uri,
-			SD:   &sd,
-		})
-		if err != nil {
-			fmt.Printf("Error publishing signal: %v\n", err)
-			span.RecordError(err)
-			return err
-		}
-
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	// signal after the commit, so that publish hooks never see the state before it
+	err = r.signal.Publish(ctx, uri, concrnt.Event{
+		Type: "created",
+		URI:  uri,
+		SD:   &sd,
+	})
+	if err != nil {
+		fmt.Printf("Error publishing signal: %v\n", err)
+		span.RecordError(err)
+	}
+
+	return nil
 }
 
+// CreateAssociation stores an association on a record of this server and publishes it to the target.
 func (r *RecordRepository) CreateAssociation(ctx context.Context, sd concrnt.SignedDocument) error {
-	ctx, span := tracer.Start(ctx, "Repository.Record.CreateAssociation")
+	return r.createAssociation(ctx, sd, true)
+}
+
+// CreateRemoteAssociation stores the author's copy of an association on a record of another server.
+// The target's server publishes and counts it.
+func (r *RecordRepository) CreateRemoteAssociation(ctx context.Context, sd concrnt.SignedDocument) error {
+	return r.createAssociation(ctx, sd, false)
+}
+
+func (r *RecordRepository) createAssociation(ctx context.Context, sd concrnt.SignedDocument, local bool) error {
+	ctx, span := tracer.Start(ctx, "Repository.Record.createAssociation")
 	defer span.End()
 
 	var doc concrnt.Document[any]
@@ -234,18 +231,10 @@ func (r *RecordRepository) CreateAssociation(ctx context.Context, sd concrnt.Sig
 		return err
 	}
 
-	hash := concrnt.GetHash([]byte(sd.Document))
-	hash10 := [10]byte{}
-	copy(hash10[:], hash[:10])
-	createdAt := doc.CreatedAt
-	documentID := cdid.New(hash10, createdAt).String()
-
-	owner := doc.Author
-	if doc.Owner != nil {
-		owner = *doc.Owner
-	}
+	documentID, owner, _ := recordIdentity(sd.Document, doc)
 
-	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+	var targetURI string
+	err = r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 
 		proof, err := json.Marshal(sd.Proof)
 		if err != nil {
@@ -286,47 +275,106 @@ func (r *RecordRepository) CreateAssociation(ctx context.Context, sd concrnt.Sig
 			}
 		}
 
-		targetRK, err := GetRecordKeyByURI(ctx, tx, *doc.Associate)
-		if err != nil {
+		targetURI = *doc.Associate
+		var targetID *int64
+		if local {
+			targetRK, err := GetRecordKeyByURI(ctx, tx, targetURI)
+			if err != nil {
+				span.RecordError(err)
+				return err
+			}
+			targetURI = targetRK.URI
+			targetID = &targetRK.ID
+		}
+
+		variant := ""
+		if doc.AssociationVariant != nil {
+			variant = *doc.AssociationVariant
+		}
+		unique := domain.AssociationUnique(owner, targetURI, doc.Schema, variant)
+
+		// associating again replaces the previous association
+		var old models.Association
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("\"unique\" = ?", unique).
+			Take(&old).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 			span.RecordError(err)
 			return err
 		}
+		if err == nil {
+			if old.DocumentID == documentID {
+				return nil
+			}
+			if err := tx.Delete(&models.Association{}, "document_id = ?", old.DocumentID).Error; err != nil {
+				span.RecordError(err)
+				return err
+			}
+			if old.TargetID != nil {
+				if err := decrementAssociationCounter(ctx, tx, *old.TargetID, old.Schema, old.Variant); err != nil {
+					span.RecordError(err)
+					return err
+				}
+			}
+			if err := tx.Model(&models.CommitLog{}).
+				Where("id = ?", old.DocumentID).
+				Update("gc_candidate", true).Error; err != nil {
+				span.RecordError(err)
+				return err
+			}
+		}
 
-		uniqueKey := owner + *doc.Associate
-		if doc.AssociationVariant != nil {
-			uniqueKey += *doc.AssociationVariant
+		value, err := json.Marshal(doc.Value)
+		if err != nil {
+			span.RecordError(err)
+			return err
 		}
-		uniqueHash := xxh3.HashString(uniqueKey)
 
 		association := models.Association{
-			TargetID:   targetRK.ID,
+			TargetID:   targetID,
+			TargetURI:  targetURI,
 			DocumentID: documentID,
-			Unique:     fmt.Sprintf("%x", uniqueHash),
-
-			Owner:  owner,
-			Schema: doc.Schema,
-			Value:  sd.Document,
-			CDate:  time.Now(),
+			Unique:     unique,
+
+			Author:  doc.Author,
+			Owner:   owner,
+			Schema:  doc.Schema,
+			Variant: variant,
+			Value:   string(value),
+			CDate:   time.Now(),
 		}
 		if err := tx.Create(&association).Error; err != nil {
 			span.RecordError(err)
 			return err
 		}
 
-		// signal
-		err = r.signal.Publish(ctx, targetRK.URI, concrnt.Event{
-			Type: "associated",
-			URI:  targetRK.URI,
-			SD:   &sd,
-		})
-		if err != nil {
-			fmt.Printf("Error publishing signal: %v\n", err)
+		if !local {
+			return nil
+		}
+
+		if err := incrementAssociationCounter(ctx, tx, association); err != nil {
 			span.RecordError(err)
 			return err
 		}
 
 		return nil
 	})
+	if err != nil || !local {
+		return err
+	}
+
+	// signal after the commit, so that publish hooks never see the state before it
+	err = r.signal.Publish(ctx, targetURI, concrnt.Event{
+		Type: "associated",
+		URI:  targetURI,
+		SD:   &sd,
+	})
+	if err != nil {
+		fmt.Printf("Error publishing signal: %v\n", err)
+		span.RecordError(err)
+	}
+
+	return nil
 }
 
 func (r *RecordRepository) CreateAck(ctx context.Context, sd concrnt.SignedDocument) error {
@@ -378,6 +426,78 @@ func (r *RecordRepository) GetSignedDocument(ctx context.Context, uri string) (*
 	return &sd, nil
 }
 
+// GetSignedDocuments returns the signed documents at uris keyed by URI. Like GetSignedDocument, a URI
+// is looked up as a document ID first and as a record key otherwise. Missing documents are left out.
+func (r *RecordRepository) GetSignedDocuments(ctx context.Context, uris []string) (map[string]concrnt.SignedDocument, error) {
+	ctx, span := tracer.Start(ctx, "Repository.Record.GetSignedDocuments")
+	defer span.End()
+
+	commits := make(map[string]models.CommitLog, len(uris))
+
+	keys := make([]string, 0, len(uris))
+	for _, uri := range uris {
+		_, key, err := concrnt.ParseCCURI(uri)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	var byID []models.CommitLog
+	err := r.db.WithContext(ctx).Where("id IN ?", keys).Find(&byID).Error
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	ids := make(map[string]models.CommitLog, len(byID))
+	for _, commit := range byID {
+		ids[commit.ID] = commit
+	}
+
+	var rest []string
+	for _, uri := range uris {
+		_, key, err := concrnt.ParseCCURI(uri)
+		if err != nil {
+			continue
+		}
+		if commit, ok := ids[key]; ok {
+			commits[uri] = commit
+		} else {
+			rest = append(rest, uri)
+		}
+	}
+
+	if len(rest) > 0 {
+		var recordKeys []models.RecordKey
+		err := r.db.WithContext(ctx).
+			Preload("Record.Document").
+			Where("uri IN ? AND record_id IS NOT NULL", rest).
+			Find(&recordKeys).Error
+		if err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+		for _, recordKey := range recordKeys {
+			commits[recordKey.URI] = recordKey.Record.Document
+		}
+	}
+
+	documents := make(map[string]concrnt.SignedDocument, len(commits))
+	for uri, commit := range commits {
+		var proof concrnt.Proof
+		err := json.Unmarshal([]byte(commit.Proof), &proof)
+		if err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+		documents[uri] = concrnt.SignedDocument{
+			Document: commit.Document,
+			Proof:    proof,
+		}
+	}
+
+	return documents, nil
+}
+
 func (r *RecordRepository) Delete(ctx context.Context, sd concrnt.SignedDocument) error {
 	ctx, span := tracer.Start(ctx, "Repository.Record.Delete")
 	defer span.End()
@@ -390,6 +510,9 @@ func (r *RecordRepository) Delete(ctx context.Context, sd concrnt.SignedDocument
 	}
 
 	record, err := getRecordByURI(ctx, r.db, string(doc.Value))
+	if errors.Is(err, domain.ErrNotFound) {
+		return r.deleteAssociation(ctx, doc)
+	}
 	if err != nil {
 		span.RecordError(err)
 		return err
@@ -397,13 +520,334 @@ func (r *RecordRepository) Delete(ctx context.Context, sd concrnt.SignedDocument
 
 	id := record.DocumentID
 
-	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+	var removed []models.RemovedItem
+	err = r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		removed, err = recordRemovals(ctx, tx, id)
+		if err != nil {
+			span.RecordError(err)
+			return err
+		}
 		if err := tx.Delete(&models.CommitLog{}, "id = ?", id).Error; err != nil {
 			span.RecordError(err)
 			return err
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	// signal
+	events := map[string]string{string(doc.Value): string(doc.Value)}
+	for _, item := range removed {
+		events[item.CollectionURI] = item.ItemID
+	}
+	for channel, uri := range events {
+		err = r.signal.Publish(ctx, channel, concrnt.Event{
+			Type: "deleted",
+			URI:  uri,
+		})
+		if err != nil {
+			fmt.Printf("Error publishing signal: %v\n", err)
+			span.RecordError(err)
+		}
+	}
+
+	return nil
+}
+
+// deleteAssociation removes the association at the URI named by doc. Either the author of the association
+// or the owner of its target may remove it.
+func (r *RecordRepository) deleteAssociation(ctx context.Context, doc concrnt.Document[schemas.Delete]) error {
+	ctx, span := tracer.Start(ctx, "Repository.Record.deleteAssociation")
+	defer span.End()
+
+	_, key, err := concrnt.ParseCCURI(string(doc.Value))
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	var association models.Association
+	err = r.db.WithContext(ctx).
+		Preload("Document").
+		Where("document_id = ?", key).
+		Take(&association).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return domain.NotFoundError{Resource: "record"}
+	}
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	targetOwner, _, err := concrnt.ParseCCURI(association.TargetURI)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	if doc.Author != association.Author && doc.Author != targetOwner {
+		return domain.ForbiddenError{Reason: "only the author or the target owner can remove an association"}
+	}
+
+	var proof concrnt.Proof
+	err = json.Unmarshal([]byte(association.Document.Proof), &proof)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	// the association goes away with its commit
+	err = r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&models.CommitLog{}, "id = ?", association.DocumentID).Error; err != nil {
+			return err
+		}
+		if association.TargetID == nil {
+			return nil
+		}
+		return decrementAssociationCounter(ctx, tx, *association.TargetID, association.Schema, association.Variant)
+	})
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	// copies of associations on remote records are published by the target's server
+	if association.TargetID == nil {
+		return nil
+	}
+
+	// signal
+	err = r.signal.Publish(ctx, association.TargetURI, concrnt.Event{
+		Type: "unassociated",
+		URI:  association.TargetURI,
+		SD: &concrnt.SignedDocument{
+			Document: association.Document.Document,
+			Proof:    proof,
+		},
+	})
+	if err != nil {
+		fmt.Printf("Error publishing signal: %v\n", err)
+		span.RecordError(err)
+	}
+
+	return nil
+}
+
+// incrementAssociationCounter counts association in the counter of its target, schema and variant.
+func incrementAssociationCounter(ctx context.Context, tx *gorm.DB, association models.Association) error {
+	counter := models.AssociationCounter{
+		TargetID:   *association.TargetID,
+		Schema:     association.Schema,
+		Variant:    association.Variant,
+		Count:      1,
+		FirstCDate: association.CDate,
+	}
+	return tx.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "target_id"}, {Name: "schema"}, {Name: "variant"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"count":        gorm.Expr("association_counters.count + 1"),
+			"first_c_date": gorm.Expr("LEAST(association_counters.first_c_date, excluded.first_c_date)"),
+		}),
+	}).Create(&counter).Error
+}
+
+// decrementAssociationCounter uncounts an association which has been deleted. The counter is removed
+// when it reaches zero.
+func decrementAssociationCounter(ctx context.Context, tx *gorm.DB, targetID int64, schema, variant string) error {
+	where := "target_id = ? AND schema = ? AND variant = ?"
+
+	err := tx.WithContext(ctx).
+		Model(&models.AssociationCounter{}).
+		Where(where, targetID, schema, variant).
+		Updates(map[string]any{
+			"count": gorm.Expr("count - 1"),
+			"first_c_date": gorm.Expr(
+				"COALESCE((SELECT MIN(c_date) FROM associations WHERE "+where+"), first_c_date)",
+				targetID, schema, variant,
+			),
+		}).Error
+	if err != nil {
+		return err
+	}
+
+	return tx.WithContext(ctx).
+		Where(where+" AND count <= 0", targetID, schema, variant).
+		Delete(&models.AssociationCounter{}).Error
+}
+
+// GetAssociationTarget returns the URI of the record the association at uri is attached to.
+func (r *RecordRepository) GetAssociationTarget(ctx context.Context, uri string) (string, error) {
+	ctx, span := tracer.Start(ctx, "Repository.Record.GetAssociationTarget")
+	defer span.End()
+
+	_, key, err := concrnt.ParseCCURI(uri)
+	if err != nil {
+		span.RecordError(err)
+		return "", err
+	}
+
+	var association models.Association
+	err = r.db.WithContext(ctx).
+		Select("target_uri").
+		Where("document_id = ?", key).
+		Take(&association).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", domain.NotFoundError{Resource: "association"}
+	}
+	if err != nil {
+		span.RecordError(err)
+		return "", err
+	}
+
+	return association.TargetURI, nil
+}
+
+// recordRemovals remembers the collection items which disappear with the document:
+// the document itself where it is a member of a collection, and references to it.
+// The references are deleted along, so that local chunk bodies no longer carry them
+// once their removal has aged out of the removed items.
+func recordRemovals(ctx context.Context, db *gorm.DB, documentID string) ([]models.RemovedItem, error) {
+	ctx, span := tracer.Start(ctx, "Repository.Record.recordRemovals")
+	defer span.End()
+
+	var recordKeys []models.RecordKey
+	err := db.WithContext(ctx).
+		Preload("Record.Document").
+		Where("record_id = ?", documentID).
+		Find(&recordKeys).Error
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	var removed []models.RemovedItem
+	hrefs := make([]string, 0, len(recordKeys))
+	for _, recordKey := range recordKeys {
+		hrefs = append(hrefs, recordKey.URI)
+		if recordKey.ParentID == nil {
+			continue
+		}
+
+		var parent models.RecordKey
+		err := db.WithContext(ctx).
+			Where("id = ?", *recordKey.ParentID).
+			Take(&parent).Error
+		if err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+
+		itemID, _, err := memberHref(recordKey)
+		if err != nil {
+			span.RecordError(err)
+		}
+		removed = append(removed, models.RemovedItem{
+			CollectionURI: parent.URI,
+			ItemID:        itemID,
+		})
+	}
+
+	if len(hrefs) > 0 {
+		var references []struct {
+			Collection string `gorm:"column:collection"`
+			Href       string `gorm:"column:href"`
+			DocumentID string `gorm:"column:document_id"`
+		}
+		err = db.WithContext(ctx).
+			Table("record_keys AS member").
+			Joins("JOIN record_keys AS parent ON parent.id = member.parent_id").
+			Joins("JOIN records r ON r.document_id = member.record_id").
+			Select("parent.uri AS collection, r.value->>'href' AS href, r.document_id AS document_id").
+			Where("r.schema = ?", schemas.ReferenceURL).
+			Where("r.value->>'href' IN ?", hrefs).
+			Scan(&references).Error
+		if err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+
+		referenceIDs := make([]string, 0, len(references))
+		for _, reference := range references {
+			removed = append(removed, models.RemovedItem{
+				CollectionURI: reference.Collection,
+				ItemID:        reference.Href,
+			})
+			referenceIDs = append(referenceIDs, reference.DocumentID)
+		}
+
+		if len(referenceIDs) > 0 {
+			// the references go away with their commits
+			err = db.WithContext(ctx).Delete(&models.CommitLog{}, "id IN ?", referenceIDs).Error
+			if err != nil {
+				span.RecordError(err)
+				return nil, err
+			}
+		}
+	}
+
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	err = db.WithContext(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&removed).Error
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	return removed, nil
+}
+
+// recordIdentity returns the document ID of a commit, the owner of its record and the record URI.
+// A {cdid} placeholder in the key is replaced with the document ID.
+func recordIdentity(document string, doc concrnt.Document[any]) (string, string, string) {
+	hash := concrnt.GetHash([]byte(document))
+	hash10 := [10]byte{}
+	copy(hash10[:], hash[:10])
+	documentID := cdid.New(hash10, doc.CreatedAt).String()
+
+	owner := doc.Author
+	if doc.Owner != nil {
+		owner = *doc.Owner
+	}
+
+	key := strings.ReplaceAll(doc.Key, "{cdid}", documentID)
+
+	return documentID, owner, concrnt.ComposeCCURI(owner, key)
+}
+
+// referenceDocument builds the reference which makes the record at uri a member of the collection memberOfURI.
+func referenceDocument(memberOfURI, owner, uri, documentID string) (concrnt.SignedDocument, error) {
+	memberOwner, key, err := concrnt.ParseCCURI(memberOfURI)
+	if err != nil {
+		return concrnt.SignedDocument{}, err
+	}
+
+	document := concrnt.Document[schemas.Reference]{
+		Key: path.Join(key, documentID),
+		Value: schemas.Reference{
+			Href: uri,
+		},
+		Author:    owner,
+		Owner:     &memberOwner,
+		Schema:    schemas.ReferenceURL,
+		CreatedAt: time.Now(),
+	}
+	docBytes, err := json.Marshal(document)
+	if err != nil {
+		return concrnt.SignedDocument{}, err
+	}
+
+	return concrnt.SignedDocument{
+		Document: string(docBytes),
+		Proof: concrnt.Proof{
+			Type: "document-reference",
+			Href: &uri,
+		},
+	}, nil
 }
 
 func getCommitByURI(ctx context.Context, db *gorm.DB, uri string) (*models.CommitLog, error) {
@@ -428,7 +872,7 @@ func getCommitByURI(ctx context.Context, db *gorm.DB, uri string) (*models.Commi
 	err = db.WithContext(ctx).Preload("Record.Document").
 		Where("uri = ?", uri).
 		Take(&recordKey).Error
-	if err == nil {
+	if err == nil && recordKey.RecordID != nil {
 		return &recordKey.Record.Document, nil
 	}
 
@@ -537,54 +981,83 @@ func GetRecordKeyByURI(ctx context.Context, db *gorm.DB, uri string) (*models.Re
 	return &recordKey, nil
 }
 
+// GetAssociatedRecords returns up to limit associations of the record at targetURI after cursor,
+// ordered by creation date and document ID, with the cursor of the next page if there is one.
+// Empty schema, variant and author match any.
 func (r *RecordRepository) GetAssociatedRecords(
 	ctx context.Context,
 	targetURI, schema, variant, author string,
-) ([]concrnt.Document[any], error) {
+	cursor *domain.QueryCursor,
+	limit int,
+	order string,
+) ([]concrnt.SignedDocument, *domain.QueryCursor, error) {
 	ctx, span := tracer.Start(ctx, "Repository.Record.GetAssociatedRecords")
 	defer span.End()
 
 	targetRK, err := GetRecordKeyByURI(ctx, r.db, targetURI)
 	if err != nil {
 		span.RecordError(err)
-		return nil, err
+		return nil, nil, err
 	}
 
-	var associations []models.Association
-
 	query := r.db.WithContext(ctx).
-		Model(&models.Association{}).
-		Preload("Item.Record.Document").
-		Joins("JOIN record_keys rk ON rk.id = associations.item_id").
-		Joins("JOIN records rec ON rec.document_id = rk.record_id").
-		Where("associations.target_id = ?", targetRK.ID)
+		Preload("Document").
+		Where("target_id = ?", targetRK.ID)
 
 	if schema != "" {
-		query = query.Where("rec.schema = ?", schema)
+		query = query.Where("schema = ?", schema)
 	}
 	if variant != "" {
-		query = query.Where("rec.variant = ?", variant)
+		query = query.Where("variant = ?", variant)
 	}
 	if author != "" {
-		query = query.Where("rec.author = ?", author)
+		query = query.Where("author = ?", author)
 	}
 
-	if err := query.Find(&associations).Error; err != nil {
-		return nil, err
+	if order == "desc" {
+		if cursor != nil {
+			query = query.Where("(c_date, document_id) < (?, ?)", cursor.CDate, cursor.DocumentID)
+		}
+		query = query.Order("c_date DESC").Order("document_id DESC")
+	} else {
+		if cursor != nil {
+			query = query.Where("(c_date, document_id) > (?, ?)", cursor.CDate, cursor.DocumentID)
+		}
+		query = query.Order("c_date ASC").Order("document_id ASC")
 	}
 
-	var documents []concrnt.Document[any]
-	for _, assoc := range associations {
-		var doc concrnt.Document[any]
-		err := json.Unmarshal([]byte(assoc.Document.Document), &doc)
+	// one more than asked tells whether there is a next page
+	var associations []models.Association
+	if err := query.Limit(limit + 1).Find(&associations).Error; err != nil {
+		span.RecordError(err)
+		return nil, nil, err
+	}
+
+	var next *domain.QueryCursor
+	if len(associations) > limit {
+		associations = associations[:limit]
+		last := associations[len(associations)-1]
+		next = &domain.QueryCursor{
+			CDate:      last.CDate,
+			DocumentID: last.DocumentID,
+		}
+	}
+
+	documents := make([]concrnt.SignedDocument, 0, len(associations))
+	for _, association := range associations {
+		var proof concrnt.Proof
+		err := json.Unmarshal([]byte(association.Document.Proof), &proof)
 		if err != nil {
 			span.RecordError(err)
-			return nil, err
+			return nil, nil, err
 		}
-		documents = append(documents, doc)
+		documents = append(documents, concrnt.SignedDocument{
+			Document: association.Document.Document,
+			Proof:    proof,
+		})
 	}
 
-	return documents, nil
+	return documents, next, nil
 }
 
 func (r *RecordRepository) GetAssociatedRecordCountsBySchema(ctx context.Context, targetURI string) (map[string]int64, error) {
@@ -603,12 +1076,10 @@ func (r *RecordRepository) GetAssociatedRecordCountsBySchema(ctx context.Context
 	}
 
 	err = r.db.WithContext(ctx).
-		Model(&models.Association{}).
-		Select("rec.schema AS schema, COUNT(*) AS count").
-		Joins("JOIN record_keys rk ON rk.id = associations.item_id").
-		Joins("JOIN records rec ON rec.document_id = rk.record_id").
-		Where("associations.target_id = ?", targetRK.ID).
-		Group("rec.schema").
+		Model(&models.AssociationCounter{}).
+		Select("schema, SUM(count) AS count").
+		Where("target_id = ?", targetRK.ID).
+		Group("schema").
 		Scan(&counts).Error
 
 	if err != nil {
@@ -642,13 +1113,10 @@ func (r *RecordRepository) GetAssociatedRecordCountsByVariant(ctx context.Contex
 	}
 
 	err = r.db.WithContext(ctx).
-		Model(&models.Association{}).
-		Select("rec.variant AS variant, COUNT(*) AS count, MIN(rec.c_date) AS min_c_date").
-		Joins("JOIN record_keys rk ON rk.id = associations.item_id").
-		Joins("JOIN records rec ON rec.document_id = rk.record_id").
-		Where("associations.target_id = ? AND rec.schema = ?", targetRK.ID, schema).
-		Group("rec.variant").
-		Order("min_c_date ASC").
+		Model(&models.AssociationCounter{}).
+		Select("variant, count, first_c_date AS min_c_date").
+		Where("target_id = ? AND schema = ?", targetRK.ID, schema).
+		Order("first_c_date ASC").
 		Scan(&counts).Error
 	if err != nil {
 		span.RecordError(err)
@@ -666,13 +1134,17 @@ func (r *RecordRepository) GetAssociatedRecordCountsByVariant(ctx context.Contex
 	return &result, nil
 }
 
+// Query returns up to limit records under prefix after cursor, ordered by creation date and document ID,
+// with the cursor of the next page if there is one. filter is checked by domain.ParseQueryFilter.
 func (r *RecordRepository) Query(
 	ctx context.Context,
 	prefix, schema string,
 	since, until *time.Time,
+	filter *policy.Expr,
+	cursor *domain.QueryCursor,
 	limit int,
 	order string,
-) (map[string]concrnt.Document[any], error) {
+) ([]concrnt.QueryItem, *domain.QueryCursor, error) {
 	ctx, span := tracer.Start(ctx, "Repository.Record.Query")
 	defer span.End()
 
@@ -692,27 +1164,229 @@ func (r *RecordRepository) Query(
 	if until != nil {
 		query = query.Where("r.c_date <= ?", *until)
 	}
+	if filter != nil {
+		cond, args, err := compileFilter(*filter)
+		if err != nil {
+			span.RecordError(err)
+			return nil, nil, err
+		}
+		query = query.Where(cond, args...)
+	}
 
 	if order == "desc" {
-		query = query.Order("r.c_date DESC")
+		if cursor != nil {
+			query = query.Where("(r.c_date, r.document_id) < (?, ?)", cursor.CDate, cursor.DocumentID)
+		}
+		query = query.Order("r.c_date DESC").Order("r.document_id DESC")
 	} else {
-		query = query.Order("r.c_date ASC")
+		if cursor != nil {
+			query = query.Where("(r.c_date, r.document_id) > (?, ?)", cursor.CDate, cursor.DocumentID)
+		}
+		query = query.Order("r.c_date ASC").Order("r.document_id ASC")
 	}
 
-	if err := query.Limit(limit).Preload("Record.Document").Find(&rks).Error; err != nil {
+	// one more than asked tells whether there is a next page
+	if err := query.Limit(limit + 1).Preload("Record.Document").Find(&rks).Error; err != nil {
 		span.RecordError(err)
-		return nil, err
+		return nil, nil, err
+	}
+
+	var next *domain.QueryCursor
+	if len(rks) > limit {
+		rks = rks[:limit]
+		last := rks[len(rks)-1].Record
+		next = &domain.QueryCursor{
+			CDate:      last.CDate,
+			DocumentID: last.DocumentID,
+		}
 	}
 
-	documents := make(map[string]concrnt.Document[any])
+	items := make([]concrnt.QueryItem, 0, len(rks))
 	for _, rk := range rks {
 		var doc concrnt.Document[any]
 		if err := json.Unmarshal([]byte(rk.Record.Document.Document), &doc); err != nil {
+			span.RecordError(err)
+			return nil, nil, err
+		}
+		items = append(items, concrnt.QueryItem{
+			URI:      rk.URI,
+			Document: doc,
+		})
+	}
+
+	return items, next, nil
+}
+
+// ListURIs returns up to limit URIs of records whose key comes after cursor, with the cursor of the next page.
+func (r *RecordRepository) ListURIs(ctx context.Context, cursor int64, limit int) ([]string, int64, error) {
+	ctx, span := tracer.Start(ctx, "Repository.Record.ListURIs")
+	defer span.End()
+
+	var rks []models.RecordKey
+	err := r.db.WithContext(ctx).
+		Select("id", "uri").
+		Where("record_id IS NOT NULL").
+		Where("id > ?", cursor).
+		Order("id ASC").
+		Limit(limit).
+		Find(&rks).Error
+	if err != nil {
+		span.RecordError(err)
+		return nil, cursor, err
+	}
+
+	uris := make([]string, 0, len(rks))
+	for _, rk := range rks {
+		uris = append(uris, rk.URI)
+		cursor = rk.ID
+	}
+
+	return uris, cursor, nil
+}
+
+// childRow is a key of the record tree with the schema of its record.
+type childRow struct {
+	ID       int64
+	ParentID *int64
+	URI      string
+	RecordID *string
+	Schema   string
+}
+
+// ListChildren lists the keys under uri in the record tree, descending depth levels.
+// The owner root (a URI without key) lists the top level keys of the owner.
+// The first level is paged by cursor, the URI of the last key of the previous page.
+// Deeper levels list at most limit keys per parent; ChildCount tells whether there are more.
+func (r *RecordRepository) ListChildren(ctx context.Context, uri string, depth int, cursor string, limit int) (*concrnt.ChildrenResult, error) {
+	ctx, span := tracer.Start(ctx, "Repository.Record.ListChildren")
+	defer span.End()
+
+	owner, key, err := concrnt.ParseCCURI(uri)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	uri = concrnt.ComposeCCURI(owner, strings.TrimSuffix(key, "/"))
+
+	first := r.db.WithContext(ctx).
+		Table("record_keys AS k").
+		Joins("LEFT JOIN records r ON r.document_id = k.record_id").
+		Select("k.id, k.parent_id, k.uri, k.record_id, r.schema")
+	if strings.Trim(key, "/") == "" {
+		uri = concrnt.ComposeCCURI(owner, "")
+		first = first.Where("k.parent_id IS NULL AND k.uri LIKE ?", escapeLike(uri)+"/%")
+	} else {
+		rk, err := GetRecordKeyByURI(ctx, r.db, uri)
+		if err != nil {
 			span.RecordError(err)
 			return nil, err
 		}
-		documents[rk.URI] = doc
+		first = first.Where("k.parent_id = ?", rk.ID)
+	}
+	if cursor != "" {
+		first = first.Where("k.uri > ?", cursor)
 	}
 
-	return documents, nil
+	var rows []childRow
+	err = first.Order("k.uri ASC").Limit(limit + 1).Scan(&rows).Error
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	var next string
+	if len(rows) > limit {
+		rows = rows[:limit]
+		next = rows[limit-1].URI
+	}
+
+	// keys of each level are grouped by their parent, the first level under 0
+	children := make(map[int64][]childRow)
+	var ids []int64
+	var parents []int64
+	for i := 0; i < depth; i++ {
+		if i > 0 {
+			if len(parents) == 0 {
+				break
+			}
+			rows = nil
+			err := r.db.WithContext(ctx).Raw(`SELECT id, parent_id, uri, record_id, schema FROM (
+				SELECT k.id, k.parent_id, k.uri, k.record_id, r.schema,
+					ROW_NUMBER() OVER (PARTITION BY k.parent_id ORDER BY k.uri) AS n
+				FROM record_keys k
+				LEFT JOIN records r ON r.document_id = k.record_id
+				WHERE k.parent_id IN ?
+			) AS t WHERE t.n <= ? ORDER BY t.uri ASC`, parents, limit).Scan(&rows).Error
+			if err != nil {
+				span.RecordError(err)
+				return nil, err
+			}
+		}
+
+		parents = parents[:0]
+		for _, row := range rows {
+			var parentID int64
+			if i > 0 {
+				parentID = *row.ParentID
+			}
+			children[parentID] = append(children[parentID], row)
+			parents = append(parents, row.ID)
+			ids = append(ids, row.ID)
+		}
+	}
+
+	counts := make(map[int64]int64)
+	if len(ids) > 0 {
+		var rows []struct {
+			ParentID int64
+			Count    int64
+		}
+		err := r.db.WithContext(ctx).
+			Model(&models.RecordKey{}).
+			Select("parent_id, COUNT(*) AS count").
+			Where("parent_id IN ?", ids).
+			Group("parent_id").
+			Scan(&rows).Error
+		if err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+		for _, row := range rows {
+			counts[row.ParentID] = row.Count
+		}
+	}
+
+	var summary concrnt.ChildrenSummary
+	err = r.db.WithContext(ctx).
+		Table("record_keys").
+		Joins("JOIN commit_logs c ON c.id = record_keys.record_id").
+		Select("COUNT(*) AS records, COALESCE(SUM(LENGTH(c.document)), 0) AS size").
+		Where("record_keys.uri LIKE ?", escapeLike(uri)+"/%").
+		Scan(&summary).Error
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	return &concrnt.ChildrenResult{
+		URI:      uri,
+		Children: childEntries(children, counts, 0),
+		Summary:  summary,
+		Next:     next,
+	}, nil
+}
+
+// childEntries builds the entries of the keys under parentID from the keys grouped by parent.
+func childEntries(children map[int64][]childRow, counts map[int64]int64, parentID int64) []concrnt.ChildEntry {
+	entries := make([]concrnt.ChildEntry, 0, len(children[parentID]))
+	for _, row := range children[parentID] {
+		entries = append(entries, concrnt.ChildEntry{
+			URI:        row.URI,
+			Schema:     row.Schema,
+			HasRecord:  row.RecordID != nil,
+			ChildCount: counts[row.ID],
+			Children:   childEntries(children, counts, row.ID),
+		})
+	}
+	return entries
 }
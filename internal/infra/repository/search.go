@@ -0,0 +1,230 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/totegamma/concrnt-playground"
+	"github.com/totegamma/concrnt-playground/internal/domain"
+	"github.com/totegamma/concrnt-playground/internal/infra/database/models"
+)
+
+// SearchConfig maps a schema to the dot separated value fields indexed for search, such as "body".
+// Records of other schemas are not searchable.
+type SearchConfig struct {
+	Fields map[string][]string
+}
+
+// searchBackfillBatchSize is the number of records indexed in one transaction by the backfill.
+const searchBackfillBatchSize = 500
+
+type SearchRepository struct {
+	db     *gorm.DB
+	config SearchConfig
+}
+
+func NewSearchRepository(db *gorm.DB, config SearchConfig) *SearchRepository {
+	return &SearchRepository{db: db, config: config}
+}
+
+// index stores the searchable text of a record within the transaction creating it.
+// Records without text get an empty entry, which tells the backfill that they are indexed.
+func (r *SearchRepository) index(ctx context.Context, tx *gorm.DB, documentID string, doc concrnt.Document[any]) error {
+	ctx, span := tracer.Start(ctx, "Repository.Search.index")
+	defer span.End()
+
+	fields, ok := r.config.Fields[doc.Schema]
+	if !ok {
+		return nil
+	}
+
+	var texts []string
+	for _, field := range fields {
+		texts = append(texts, searchTexts(doc.Value, strings.Split(field, "."))...)
+	}
+
+	entry := models.SearchEntry{
+		DocumentID: documentID,
+		Text:       strings.ToLower(strings.Join(texts, "\n")),
+		Fields:     strings.Join(fields, ","),
+	}
+	err := tx.WithContext(ctx).
+		Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "document_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"text", "fields"}),
+		}).
+		Create(&entry).Error
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+// Backfill indexes the records of the configured schemas which have no entry for the configured
+// fields yet, and drops the entries of schemas which are no longer configured. It returns the
+// number of records indexed. Records created meanwhile are indexed by their commit as usual.
+func (r *SearchRepository) Backfill(ctx context.Context) (int, error) {
+	ctx, span := tracer.Start(ctx, "Repository.Search.Backfill")
+	defer span.End()
+
+	configured := make([]string, 0, len(r.config.Fields))
+	for schema := range r.config.Fields {
+		configured = append(configured, schema)
+	}
+	err := r.db.WithContext(ctx).Exec(
+		"DELETE FROM search_entries s USING records r WHERE r.document_id = s.document_id AND r.schema NOT IN ?",
+		configured,
+	).Error
+	if err != nil {
+		span.RecordError(err)
+		return 0, err
+	}
+
+	indexed := 0
+	for schema, fields := range r.config.Fields {
+		last := ""
+		for {
+			var records []models.Record
+			err := r.db.WithContext(ctx).
+				Preload("Document").
+				Where("schema = ? AND document_id > ?", schema, last).
+				Where(
+					"NOT EXISTS (SELECT 1 FROM search_entries s WHERE s.document_id = records.document_id AND s.fields = ?)",
+					strings.Join(fields, ","),
+				).
+				Order("document_id ASC").
+				Limit(searchBackfillBatchSize).
+				Find(&records).Error
+			if err != nil {
+				span.RecordError(err)
+				return indexed, err
+			}
+			if len(records) == 0 {
+				break
+			}
+
+			err = r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+				for _, record := range records {
+					var doc concrnt.Document[any]
+					err := json.Unmarshal([]byte(record.Document.Document), &doc)
+					if err != nil {
+						return err
+					}
+					err = r.index(ctx, tx, record.DocumentID, doc)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				span.RecordError(err)
+				return indexed, err
+			}
+
+			indexed += len(records)
+			last = records[len(records)-1].DocumentID
+		}
+	}
+
+	return indexed, nil
+}
+
+// searchTexts returns the strings at path in value. Arrays on the way are searched element by element.
+func searchTexts(value any, path []string) []string {
+	switch v := value.(type) {
+	case string:
+		if len(path) == 0 {
+			return []string{v}
+		}
+	case []any:
+		var texts []string
+		for _, item := range v {
+			texts = append(texts, searchTexts(item, path)...)
+		}
+		return texts
+	case map[string]any:
+		if len(path) > 0 {
+			return searchTexts(v[path[0]], path[1:])
+		}
+	}
+	return nil
+}
+
+// Search returns up to limit records under prefix matching q, newest first, after cursor.
+// Words are matched with full-text search and anything else as a substring.
+func (r *SearchRepository) Search(
+	ctx context.Context,
+	q, prefix, schema string,
+	cursor *domain.QueryCursor,
+	limit int,
+) ([]concrnt.QueryItem, *domain.QueryCursor, error) {
+	ctx, span := tracer.Start(ctx, "Repository.Search.Search")
+	defer span.End()
+
+	q = strings.ToLower(q)
+	pattern := "%" + escapeLike(q) + "%"
+
+	var rks []models.RecordKey
+	query := r.db.WithContext(ctx).
+		Model(&models.RecordKey{}).
+		Joins("JOIN records r ON r.document_id = record_keys.record_id").
+		Joins("JOIN search_entries s ON s.document_id = r.document_id").
+		Where("(to_tsvector('simple', s.text) @@ websearch_to_tsquery('simple', ?) OR s.text LIKE ?)", q, pattern)
+
+	if prefix != "" {
+		query = query.Where("record_keys.uri LIKE ?", prefix+"%")
+	}
+	if schema != "" {
+		query = query.Where("r.schema = ?", schema)
+	}
+	if cursor != nil {
+		query = query.Where("(r.c_date, r.document_id) < (?, ?)", cursor.CDate, cursor.DocumentID)
+	}
+
+	// one more than asked tells whether there is a next page
+	err := query.
+		Order("r.c_date DESC").Order("r.document_id DESC").
+		Limit(limit + 1).
+		Preload("Record.Document").
+		Find(&rks).Error
+	if err != nil {
+		span.RecordError(err)
+		return nil, nil, err
+	}
+
+	var next *domain.QueryCursor
+	if len(rks) > limit {
+		rks = rks[:limit]
+		last := rks[len(rks)-1].Record
+		next = &domain.QueryCursor{
+			CDate:      last.CDate,
+			DocumentID: last.DocumentID,
+		}
+	}
+
+	items := make([]concrnt.QueryItem, 0, len(rks))
+	for _, rk := range rks {
+		var doc concrnt.Document[any]
+		if err := json.Unmarshal([]byte(rk.Record.Document.Document), &doc); err != nil {
+			span.RecordError(err)
+			return nil, nil, err
+		}
+		items = append(items, concrnt.QueryItem{
+			URI:      rk.URI,
+			Document: doc,
+		})
+	}
+
+	return items, next, nil
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
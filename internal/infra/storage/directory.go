@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/totegamma/concrnt-playground/internal/domain"
+)
+
+// Directory stores files under a local directory, to be served by any file server.
+type Directory struct {
+	root string
+	mu   sync.Mutex
+}
+
+func NewDirectory(root string) *Directory {
+	return &Directory{root: root}
+}
+
+// path maps name into the root. Cleaning it as an absolute path keeps it from escaping the root.
+func (d *Directory) path(name string) (string, error) {
+	clean := filepath.Clean("/" + filepath.FromSlash(name))
+	if clean == string(filepath.Separator) {
+		return "", errors.New("empty path")
+	}
+	return filepath.Join(d.root, clean), nil
+}
+
+// Put writes the file through a temporary file, so that readers never see it half written.
+func (d *Directory) Put(ctx context.Context, name, contentType string, body []byte) error {
+	path, err := d.path(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(body)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Chmod(0o644)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (d *Directory) Get(ctx context.Context, name string) ([]byte, error) {
+	path, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, domain.NotFoundError{Resource: name}
+	}
+	return body, err
+}
+
+// Delete removes the file. Missing files are not an error.
+func (d *Directory) Delete(ctx context.Context, name string) error {
+	path, err := d.path(name)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// GetVersion also returns the version of the file, which is the hash of its content.
+func (d *Directory) GetVersion(ctx context.Context, name string) ([]byte, string, error) {
+	body, err := d.Get(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+	hash := sha256.Sum256(body)
+	return body, hex.EncodeToString(hash[:]), nil
+}
+
+// PutIfVersion writes the file only if it is still at version, or does not exist for an empty version.
+// Conditional writes are serialized within this process only.
+func (d *Directory) PutIfVersion(ctx context.Context, name, contentType string, body []byte, version string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, current, err := d.GetVersion(ctx, name)
+	if err != nil && !errors.Is(err, domain.ErrNotFound) {
+		return err
+	}
+	if current != version {
+		return domain.ConflictError{Resource: name}
+	}
+
+	return d.Put(ctx, name, contentType, body)
+}
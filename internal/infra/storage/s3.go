@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/totegamma/concrnt-playground/internal/domain"
+)
+
+// S3Config locates an S3 compatible bucket, such as AWS S3 or MinIO.
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. https://s3.ap-northeast-1.amazonaws.com or http://minio:9000.
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	AccessKey string `yaml:"accessKey"`
+	SecretKey string `yaml:"secretKey"`
+	// Prefix is prepended to every object key.
+	Prefix string `yaml:"prefix"`
+}
+
+// S3 stores files as objects of an S3 compatible bucket. Requests are signed with AWS Signature Version 4
+// and use path style addressing, which both AWS and MinIO accept.
+type S3 struct {
+	config S3Config
+	client *http.Client
+	now    func() time.Time
+}
+
+func NewS3(config S3Config) *S3 {
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	return &S3{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+		now:    time.Now,
+	}
+}
+
+func (s *S3) objectURL(name string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.config.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimPrefix(s.config.Prefix+"/"+strings.TrimPrefix(name, "/"), "/")
+	u.Path = u.Path + "/" + s.config.Bucket + "/" + key
+	// escape the path the way the signature expects, which is stricter than net/url
+	u.RawPath = awsEscapePath(u.Path)
+	return u, nil
+}
+
+func (s *S3) do(ctx context.Context, method, name string, header http.Header, body []byte) (*http.Response, error) {
+	u, err := s.objectURL(name)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, body)
+
+	return s.client.Do(req)
+}
+
+func (s *S3) Put(ctx context.Context, name, contentType string, body []byte) error {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+
+	resp, err := s.do(ctx, http.MethodPut, name, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, name string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, domain.NotFoundError{Resource: name}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// GetVersion also returns the ETag of the object.
+func (s *S3) GetVersion(ctx context.Context, name string) ([]byte, string, error) {
+	resp, err := s.do(ctx, http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", domain.NotFoundError{Resource: name}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", responseError(resp)
+	}
+	body, err := io.ReadAll(resp.Body)
+	return body, resp.Header.Get("ETag"), err
+}
+
+// PutIfVersion writes the object only if its ETag is still version, or it does not exist for an empty version.
+func (s *S3) PutIfVersion(ctx context.Context, name, contentType string, body []byte, version string) error {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	if version == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", version)
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, name, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// 409 is returned when a concurrent conditional write is in progress
+	if resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusConflict {
+		return domain.ConflictError{Resource: name}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
+
+// Delete removes the object. S3 answers deletes of missing objects with success as well.
+func (s *S3) Delete(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, name, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return responseError(resp)
+	}
+	return nil
+}
+
+func responseError(resp *http.Response) error {
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3: %s %s: %d %s", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, message)
+}
+
+// sign adds the AWS Signature Version 4 headers to req. Every header set on req is signed.
+func (s *S3) sign(req *http.Request, body []byte) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func awsEscape(s string) string {
+	return strings.ReplaceAll(awsEscapePath(s), "/", "%2F")
+}
+
+// awsEscapePath escapes everything but unreserved characters and slashes.
+func awsEscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
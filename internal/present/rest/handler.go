@@ -3,23 +3,43 @@ package rest
 import (
 	"errors"
 	"fmt"
-	"log/slog"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/totegamma/concrnt-playground"
 	"github.com/totegamma/concrnt-playground/internal/domain"
 	"github.com/totegamma/concrnt-playground/internal/present/rest/presenter"
 	"github.com/totegamma/concrnt-playground/internal/service"
 	"github.com/totegamma/concrnt-playground/internal/usecase"
+	"github.com/totegamma/concrnt-playground/policy"
 )
 
+// Browser and proxy cache lifetimes of chunkline responses. Closed chunks only
+// change on deletions, which readers also learn from the removed items.
+const (
+	openChunkMaxAge    = 5 * time.Second
+	closedChunkMaxAge  = 24 * time.Hour
+	removedItemsMaxAge = 30 * time.Second
+)
+
+// maxChunklineBatchSize is the number of timelines a batch request may ask for.
+const maxChunklineBatchSize = 100
+
+// maxResourceBatchSize is the number of URIs a batch resource request may ask for.
+const maxResourceBatchSize = 100
+
+// maxChildrenDepth is the number of levels a children listing may descend.
+const maxChildrenDepth = 5
+
+// maxChildrenLimit is the number of keys a children listing returns per level and parent.
+const maxChildrenLimit = 500
+
 type Handler struct {
 	config    domain.Config
 	info      concrnt.SoftwareInfo
@@ -27,6 +47,8 @@ type Handler struct {
 	chunkline *usecase.ChunklineUsecase
 	server    *usecase.ServerUsecase
 	entity    *usecase.EntityUsecase
+	realtime  *usecase.RealtimeUsecase
+	search    *usecase.SearchUsecase
 	signal    *service.SignalService
 }
 
@@ -37,6 +59,8 @@ func NewHandler(
 	chunkline *usecase.ChunklineUsecase,
 	server *usecase.ServerUsecase,
 	entity *usecase.EntityUsecase,
+	realtime *usecase.RealtimeUsecase,
+	search *usecase.SearchUsecase,
 	signal *service.SignalService,
 ) *Handler {
 	return &Handler{
@@ -46,22 +70,46 @@ func NewHandler(
 		chunkline: chunkline,
 		server:    server,
 		entity:    entity,
+		realtime:  realtime,
+		search:    search,
 		signal:    signal,
 	}
 }
 
+// RegisterCommitRoutes registers the routes of the write-on-commit mode. Everything else is
+// served as static files, so only the record usecase is needed.
+func (h *Handler) RegisterCommitRoutes(e *echo.Echo) {
+	e.POST("/commit", h.handleCommit)
+	e.GET("/health", func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+}
+
 func (h *Handler) RegisterRoutes(e *echo.Echo) {
 	e.GET("/.well-known/concrnt", h.handleWellKnown)
 	e.POST("/commit", h.handleCommit)
 	e.GET("/resource/:uri", h.handleResource)
+	e.POST("/resources", h.handleResourceBatch)
 	e.GET("/query", h.handleQuery)
+	e.GET("/children", h.handleChildren)
+	if h.search != nil {
+		e.GET("/search", h.handleSearch)
+	}
 	e.GET("/chunkline/:owner/:key/:chunk/itr", h.handleChunklineItr)
 	e.GET("/chunkline/:owner/:key/:chunk/body", h.handleChunklineBody)
+	e.GET("/chunkline/:owner/:key/:chunk/asc/itr", h.handleChunklineAscendingItr)
+	e.GET("/chunkline/:owner/:key/:chunk/asc/body", h.handleChunklineAscendingBody)
+	e.GET("/chunkline/:owner/:key/removed", h.handleChunklineRemoved)
+	e.POST("/chunkline/itr", h.handleChunklineItrBatch)
+	e.POST("/chunkline/body", h.handleChunklineBodyBatch)
 	e.POST("/api/v1/register", h.handleRegister)
 	e.GET("/api/v1/timeline/recent", h.handleTimelineRecent)
+	e.GET("/api/v1/timeline/range", h.handleTimelineRange)
 	e.GET("/associations", h.handleAssociations)
 	e.GET("/association-counts", h.handleAssociationCounts)
 	e.GET("/realtime", h.handleRealtime)
+	e.GET("/realtime/sse", h.handleRealtimeSSE)
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
 
 	e.GET("/health", func(c echo.Context) (err error) {
 		// ctx := c.Request().Context()
@@ -92,6 +140,11 @@ func (h *Handler) handleWellKnown(c echo.Context) error {
 			"net.concrnt.resource": {
 				Template: "/resource/{uri}",
 				Method:   "GET",
+				Query:    &[]string{"associationCounts"},
+			},
+			"net.concrnt.resources": {
+				Template: "/resources",
+				Method:   "POST",
 			},
 			"net.concrnt.commit": {
 				Template: "/commit",
@@ -100,12 +153,17 @@ func (h *Handler) handleWellKnown(c echo.Context) error {
 			"net.concrnt.query": {
 				Template: "/query",
 				Method:   "GET",
-				Query:    &[]string{"prefix", "schema", "since", "until", "limit", "order"},
+				Query:    &[]string{"prefix", "schema", "since", "until", "limit", "order", "cursor", "filter"},
+			},
+			"net.concrnt.children": {
+				Template: "/children",
+				Method:   "GET",
+				Query:    &[]string{"uri", "depth", "limit", "cursor"},
 			},
 			"net.concrnt.associations": {
 				Template: "/associations",
 				Method:   "GET",
-				Query:    &[]string{"uri", "schema", "variant", "author"},
+				Query:    &[]string{"uri", "schema", "variant", "author", "limit", "order", "cursor"},
 			},
 			"net.concrnt.association-counts": {
 				Template: "/association-counts",
@@ -121,13 +179,31 @@ func (h *Handler) handleWellKnown(c echo.Context) error {
 				Method:   "GET",
 				Query:    &[]string{"uris", "until", "limit"},
 			},
+			"net.concrnt.world.timeline.range": {
+				Template: "/api/v1/timeline/range",
+				Method:   "GET",
+				Query:    &[]string{"uris", "since", "limit"},
+			},
 			"net.concrnt.realtime": {
 				Template: "/realtime",
 				Method:   "GET",
+				Version:  realtimeProtocolVersion,
+			},
+			"net.concrnt.realtime.sse": {
+				Template: "/realtime/sse",
+				Method:   "GET",
+				Query:    &[]string{"prefixes", "since"},
 			},
 		},
 		SoftwareInfo: h.info,
 	}
+	if h.search != nil {
+		wellknown.Endpoints["net.concrnt.search"] = concrnt.ConcrntEndpoint{
+			Template: "/search",
+			Method:   "GET",
+			Query:    &[]string{"q", "prefix", "schema", "limit", "cursor"},
+		}
+	}
 	return presenter.OK(c, wellknown)
 }
 
@@ -142,6 +218,12 @@ func (h *Handler) handleCommit(c echo.Context) error {
 
 	err = h.record.Commit(ctx, sd)
 	if err != nil {
+		if errors.Is(err, domain.ErrForbidden) {
+			return presenter.Forbidden(c, err.Error())
+		}
+		if errors.Is(err, domain.ErrNotFound) {
+			return presenter.NotFound(c, "resource not found")
+		}
 		return presenter.InternalError(c, err)
 	}
 
@@ -214,9 +296,42 @@ func (h *Handler) handleResource(c echo.Context) error {
 			}
 			return presenter.InternalError(c, err)
 		}
-		return presenter.OK(c, value)
+		if c.QueryParam("associationCounts") != "true" {
+			return presenter.OK(c, value)
+		}
+
+		counts, err := h.record.GetAssociatedRecordCountsBySchema(ctx, uri.String())
+		if err != nil && !errors.Is(err, domain.ErrNotFound) {
+			return presenter.InternalError(c, err)
+		}
+		if counts == nil {
+			counts = map[string]int64{}
+		}
+		return presenter.OK(c, concrnt.ResourceWithCounts{
+			SignedDocument:    *value,
+			AssociationCounts: counts,
+		})
+	}
+
+}
+
+func (h *Handler) handleResourceBatch(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var req concrnt.ResourceBatchRequest
+	err := c.Bind(&req)
+	if err != nil {
+		return presenter.BadRequest(c, err)
+	}
+	if len(req.URIs) == 0 || len(req.URIs) > maxResourceBatchSize {
+		return presenter.BadRequestMessage(c, fmt.Sprintf("uris must contain 1 to %d resources", maxResourceBatchSize))
 	}
 
+	results, err := h.record.GetSignedBatch(ctx, req.URIs, req.Remote)
+	if err != nil {
+		return presenter.InternalError(c, err)
+	}
+	return presenter.OK(c, results)
 }
 
 func (h *Handler) handleQuery(c echo.Context) error {
@@ -253,7 +368,7 @@ func (h *Handler) handleQuery(c echo.Context) error {
 	limitStr := c.QueryParam("limit")
 	if limitStr != "" {
 		limitInt, err := strconv.Atoi(limitStr)
-		if err != nil {
+		if err != nil || limitInt < 1 {
 			return presenter.BadRequestMessage(c, "invalid limit parameter")
 		}
 		limit = limitInt
@@ -269,11 +384,125 @@ func (h *Handler) handleQuery(c echo.Context) error {
 		return presenter.BadRequestMessage(c, "invalid order parameter")
 	}
 
-	results, err := h.record.Query(ctx, prefix, schema, since, until, limit, order)
+	var cursor *domain.QueryCursor
+	cursorStr := c.QueryParam("cursor")
+	if cursorStr != "" {
+		parsed, err := domain.ParseQueryCursor(cursorStr)
+		if err != nil {
+			return presenter.BadRequestMessage(c, "invalid cursor parameter")
+		}
+		cursor = &parsed
+	}
+
+	var filter *policy.Expr
+	filterStr := c.QueryParam("filter")
+	if filterStr != "" {
+		parsed, err := domain.ParseQueryFilter(filterStr)
+		if err != nil {
+			return presenter.BadRequestMessage(c, "invalid filter parameter: "+err.Error())
+		}
+		filter = &parsed
+	}
+
+	items, next, err := h.record.Query(ctx, prefix, schema, since, until, filter, cursor, limit, order)
 	if err != nil {
 		return presenter.InternalError(c, err)
 	}
-	return presenter.OK(c, results)
+
+	result := concrnt.QueryResult{Items: items}
+	if next != nil {
+		result.Next = next.Encode()
+	}
+	return presenter.OK(c, result)
+}
+
+func (h *Handler) handleSearch(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	q := c.QueryParam("q")
+	if q == "" {
+		return presenter.BadRequestMessage(c, "q parameter is required")
+	}
+	prefix := c.QueryParam("prefix")
+	schema := c.QueryParam("schema")
+
+	limit := 10
+	limitStr := c.QueryParam("limit")
+	if limitStr != "" {
+		limitInt, err := strconv.Atoi(limitStr)
+		if err != nil || limitInt < 1 {
+			return presenter.BadRequestMessage(c, "invalid limit parameter")
+		}
+		limit = limitInt
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	var cursor *domain.QueryCursor
+	cursorStr := c.QueryParam("cursor")
+	if cursorStr != "" {
+		parsed, err := domain.ParseQueryCursor(cursorStr)
+		if err != nil {
+			return presenter.BadRequestMessage(c, "invalid cursor parameter")
+		}
+		cursor = &parsed
+	}
+
+	items, next, err := h.search.Search(ctx, q, prefix, schema, cursor, limit)
+	if err != nil {
+		return presenter.InternalError(c, err)
+	}
+
+	result := concrnt.QueryResult{Items: items}
+	if next != nil {
+		result.Next = next.Encode()
+	}
+	return presenter.OK(c, result)
+}
+
+func (h *Handler) handleChildren(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	uri := c.QueryParam("uri")
+	if uri == "" {
+		return presenter.BadRequestMessage(c, "uri parameter is required")
+	}
+
+	depth := 1
+	depthStr := c.QueryParam("depth")
+	if depthStr != "" {
+		depthInt, err := strconv.Atoi(depthStr)
+		if err != nil || depthInt < 1 {
+			return presenter.BadRequestMessage(c, "invalid depth parameter")
+		}
+		depth = depthInt
+	}
+	if depth > maxChildrenDepth {
+		depth = maxChildrenDepth
+	}
+
+	limit := 100
+	limitStr := c.QueryParam("limit")
+	if limitStr != "" {
+		limitInt, err := strconv.Atoi(limitStr)
+		if err != nil || limitInt < 1 {
+			return presenter.BadRequestMessage(c, "invalid limit parameter")
+		}
+		limit = limitInt
+	}
+	if limit > maxChildrenLimit {
+		limit = maxChildrenLimit
+	}
+
+	result, err := h.record.ListChildren(ctx, uri, depth, c.QueryParam("cursor"), limit)
+	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			return presenter.NotFound(c, "resource not found")
+		}
+		return presenter.InternalError(c, err)
+	}
+	return presenter.OK(c, result)
 }
 
 func (h *Handler) handleChunklineItr(c echo.Context) error {
@@ -294,7 +523,7 @@ func (h *Handler) handleChunklineItr(c echo.Context) error {
 		return presenter.InternalError(c, err)
 	}
 
-	return c.String(http.StatusOK, strconv.FormatInt(results[uri], 10))
+	return presenter.CacheableText(c, strconv.FormatInt(results[uri], 10), openChunkMaxAge)
 }
 
 func (h *Handler) handleChunklineBody(c echo.Context) error {
@@ -309,13 +538,117 @@ func (h *Handler) handleChunklineBody(c echo.Context) error {
 	if err != nil {
 		return presenter.BadRequestMessage(c, "invalid chunk id")
 	}
-	results, err := h.chunkline.LoadLocalBody(ctx, uri, chunkID)
+	results, closed, err := h.chunkline.LoadLocalBody(ctx, uri, chunkID)
+	if err != nil {
+		return presenter.InternalError(c, err)
+	}
+	if closed {
+		return presenter.Cacheable(c, results, closedChunkMaxAge)
+	}
+	return presenter.Cacheable(c, results, openChunkMaxAge)
+}
+
+// handleChunklineAscendingItr answers the first chunk with items at or after the requested one.
+// When there is none the requested chunk is returned, whose body is then empty.
+func (h *Handler) handleChunklineAscendingItr(c echo.Context) error {
+	ctx := c.Request().Context()
+	key, err := url.PathUnescape(c.Param("key"))
+	if err != nil {
+		return presenter.BadRequestMessage(c, "invalid key")
+	}
+	uri := concrnt.ComposeCCURI(c.Param("owner"), key)
+
+	chunkID, err := strconv.ParseInt(c.Param("chunk"), 10, 64)
+	if err != nil {
+		return presenter.BadRequestMessage(c, "invalid chunk id")
+	}
+
+	results, err := h.chunkline.LookupLocalAscendingItrs(ctx, []string{uri}, chunkID)
+	if err != nil {
+		return presenter.InternalError(c, err)
+	}
+
+	itr, ok := results[uri]
+	if !ok {
+		itr = chunkID
+	}
+
+	return presenter.CacheableText(c, strconv.FormatInt(itr, 10), openChunkMaxAge)
+}
+
+func (h *Handler) handleChunklineAscendingBody(c echo.Context) error {
+	ctx := c.Request().Context()
+	key, err := url.PathUnescape(c.Param("key"))
+	if err != nil {
+		return presenter.BadRequestMessage(c, "invalid key")
+	}
+	uri := concrnt.ComposeCCURI(c.Param("owner"), key)
+
+	chunkID, err := strconv.ParseInt(c.Param("chunk"), 10, 64)
+	if err != nil {
+		return presenter.BadRequestMessage(c, "invalid chunk id")
+	}
+	results, closed, err := h.chunkline.LoadLocalAscendingBody(ctx, uri, chunkID)
+	if err != nil {
+		return presenter.InternalError(c, err)
+	}
+	if closed {
+		return presenter.Cacheable(c, results, closedChunkMaxAge)
+	}
+	return presenter.Cacheable(c, results, openChunkMaxAge)
+}
+
+func (h *Handler) handleChunklineItrBatch(c echo.Context) error {
+	ctx := c.Request().Context()
+	var req concrnt.ChunklineItrBatchRequest
+	err := c.Bind(&req)
+	if err != nil {
+		return presenter.BadRequest(c, err)
+	}
+	if len(req.URIs) == 0 || len(req.URIs) > maxChunklineBatchSize {
+		return presenter.BadRequestMessage(c, fmt.Sprintf("uris must contain 1 to %d timelines", maxChunklineBatchSize))
+	}
+
+	results, err := h.chunkline.LookupLocalItrs(ctx, req.URIs, req.Chunk)
 	if err != nil {
 		return presenter.InternalError(c, err)
 	}
 	return presenter.OK(c, results)
 }
 
+func (h *Handler) handleChunklineBodyBatch(c echo.Context) error {
+	ctx := c.Request().Context()
+	var req concrnt.ChunklineBodyBatchRequest
+	err := c.Bind(&req)
+	if err != nil {
+		return presenter.BadRequest(c, err)
+	}
+	if len(req.Chunks) == 0 || len(req.Chunks) > maxChunklineBatchSize {
+		return presenter.BadRequestMessage(c, fmt.Sprintf("chunks must contain 1 to %d timelines", maxChunklineBatchSize))
+	}
+
+	results, err := h.chunkline.LoadLocalBodies(ctx, req.Chunks)
+	if err != nil {
+		return presenter.InternalError(c, err)
+	}
+	return presenter.OK(c, results)
+}
+
+func (h *Handler) handleChunklineRemoved(c echo.Context) error {
+	ctx := c.Request().Context()
+	key, err := url.PathUnescape(c.Param("key"))
+	if err != nil {
+		return presenter.BadRequestMessage(c, "invalid key")
+	}
+	uri := concrnt.ComposeCCURI(c.Param("owner"), key)
+
+	results, err := h.chunkline.GetRemovedItems(ctx, uri)
+	if err != nil {
+		return presenter.InternalError(c, err)
+	}
+	return presenter.Cacheable(c, results, removedItemsMaxAge)
+}
+
 func (h *Handler) handleRegister(c echo.Context) error {
 	ctx := c.Request().Context()
 	var req concrnt.RegisterRequest[domain.EntityMeta]
@@ -366,6 +699,39 @@ func (h *Handler) handleTimelineRecent(c echo.Context) error {
 	return presenter.OK(c, results)
 }
 
+func (h *Handler) handleTimelineRange(c echo.Context) error {
+	ctx := c.Request().Context()
+	uriString := c.QueryParam("uris")
+	uris := strings.Split(uriString, ",")
+	sinceStr := c.QueryParam("since")
+	if sinceStr == "" {
+		return presenter.BadRequestMessage(c, "since parameter is required")
+	}
+	sinceInt, err := strconv.ParseInt(sinceStr, 10, 64)
+	if err != nil {
+		return presenter.BadRequestMessage(c, "invalid since parameter")
+	}
+	since := time.Unix(sinceInt, 0).UTC()
+	limit := 16
+	limitStr := c.QueryParam("limit")
+	if limitStr != "" {
+		limitInt, err := strconv.Atoi(limitStr)
+		if err != nil {
+			return presenter.BadRequestMessage(c, "invalid limit parameter")
+		}
+		limit = limitInt
+	}
+	if limit > 64 {
+		limit = 64
+	}
+
+	results, err := h.chunkline.GetRange(ctx, uris, since, limit)
+	if err != nil {
+		return presenter.InternalError(c, err)
+	}
+	return presenter.OK(c, results)
+}
+
 func (h *Handler) handleAssociations(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -378,12 +744,49 @@ func (h *Handler) handleAssociations(c echo.Context) error {
 		return presenter.BadRequestMessage(c, "uri parameter is required")
 	}
 
-	records, err := h.record.GetAssociatedRecords(ctx, uri, schema, variant, author)
+	limit := 10
+	limitStr := c.QueryParam("limit")
+	if limitStr != "" {
+		limitInt, err := strconv.Atoi(limitStr)
+		if err != nil || limitInt < 1 {
+			return presenter.BadRequestMessage(c, "invalid limit parameter")
+		}
+		limit = limitInt
+	}
+	if limit > 100 {
+		limit = 100
+	}
+
+	order := c.QueryParam("order")
+	if order == "" {
+		order = "asc"
+	} else if order != "asc" && order != "desc" {
+		return presenter.BadRequestMessage(c, "invalid order parameter")
+	}
+
+	var cursor *domain.QueryCursor
+	cursorStr := c.QueryParam("cursor")
+	if cursorStr != "" {
+		parsed, err := domain.ParseQueryCursor(cursorStr)
+		if err != nil {
+			return presenter.BadRequestMessage(c, "invalid cursor parameter")
+		}
+		cursor = &parsed
+	}
+
+	items, next, err := h.record.GetAssociatedRecords(ctx, uri, schema, variant, author, cursor, limit, order)
 	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			return presenter.NotFound(c, "resource not found")
+		}
 		return presenter.InternalError(c, err)
 	}
-	return presenter.OK(c, records)
 
+	result := concrnt.AssociationResult{Items: items}
+	if next != nil {
+		result.Next = next.Encode()
+	}
+	return presenter.OK(c, result)
 }
 
 func (h *Handler) handleAssociationCounts(c echo.Context) error {
@@ -411,105 +814,3 @@ func (h *Handler) handleAssociationCounts(c echo.Context) error {
 	}
 
 }
-
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
-
-type Request struct {
-	Type     string   `json:"type"`
-	Prefixes []string `json:"prefixes"`
-}
-
-func (h *Handler) handleRealtime(c echo.Context) error {
-	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
-	if err != nil {
-		slog.Error(
-			"Failed to upgrade WebSocket",
-			slog.String("error", err.Error()),
-			slog.String("module", "socket"),
-		)
-		return err
-	}
-	defer func() {
-		ws.Close()
-	}()
-
-	ctx := c.Request().Context()
-
-	input := make(chan []string)
-	defer close(input)
-	output := make(chan concrnt.Event)
-	defer close(output)
-
-	go h.signal.Realtime(ctx, input, output)
-
-	quit := make(chan struct{})
-
-	go func() {
-		for {
-			var req Request
-			err := ws.ReadJSON(&req)
-			if err != nil {
-
-				wsErr, ok := err.(*websocket.CloseError)
-				if ok {
-					if !(wsErr.Code == websocket.CloseNormalClosure || wsErr.Code == websocket.CloseGoingAway) {
-						slog.DebugContext(
-							ctx, "WebSocket closed",
-							slog.String("error", wsErr.Error()),
-							slog.String("module", "socket"),
-						)
-					}
-				} else {
-					slog.ErrorContext(
-						ctx, "Error reading message",
-						slog.String("error", err.Error()),
-						slog.String("module", "socket"),
-					)
-				}
-
-				quit <- struct{}{}
-				break
-			}
-
-			switch req.Type {
-			case "listen":
-				input <- req.Prefixes
-				slog.DebugContext(
-					ctx, fmt.Sprintf("Socket subscribe: %s", req.Prefixes),
-					slog.String("module", "socket"),
-				)
-			case "h": // heartbeat
-				// do nothing
-			default:
-				slog.InfoContext(
-					ctx, "Unknown request type",
-					slog.String("type", req.Type),
-					slog.String("module", "socket"),
-				)
-			}
-		}
-	}()
-
-	for {
-		select {
-		case <-quit:
-			return nil
-		case items := <-output:
-			err := ws.WriteJSON(items)
-			if err != nil {
-				slog.ErrorContext(
-					ctx, "Error writing message",
-					slog.String("error", err.Error()),
-					slog.String("module", "socket"),
-				)
-				return nil
-			}
-		}
-	}
-}
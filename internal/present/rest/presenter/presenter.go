@@ -1,10 +1,13 @@
 package presenter
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/zeebo/xxh3"
 )
 
 type errorResponse struct {
@@ -40,3 +43,33 @@ func Forbidden(c echo.Context, msg string) error {
 	fmt.Println("Forbidden:", msg)
 	return c.JSON(http.StatusForbidden, errorResponse{Error: msg})
 }
+
+// Cacheable writes payload with an ETag and lets clients and proxies reuse it for maxAge.
+// Requests whose If-None-Match matches are answered with 304 Not Modified.
+func Cacheable(c echo.Context, payload any, maxAge time.Duration) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return InternalError(c, err)
+	}
+	if notModified(c, body, maxAge) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.JSONBlob(http.StatusOK, body)
+}
+
+// CacheableText is Cacheable for plain text responses.
+func CacheableText(c echo.Context, text string, maxAge time.Duration) error {
+	if notModified(c, []byte(text), maxAge) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.String(http.StatusOK, text)
+}
+
+// notModified sets the caching headers for body and reports whether the client already has it.
+func notModified(c echo.Context, body []byte, maxAge time.Duration) bool {
+	etag := fmt.Sprintf(`"%x"`, xxh3.Hash(body))
+	header := c.Response().Header()
+	header.Set("ETag", etag)
+	header.Set(echo.HeaderCacheControl, fmt.Sprintf("public, max-age=%d", int(maxAge/time.Second)))
+	return c.Request().Header.Get("If-None-Match") == etag
+}
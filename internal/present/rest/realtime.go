@@ -0,0 +1,357 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+
+	"github.com/totegamma/concrnt-playground"
+	"github.com/totegamma/concrnt-playground/internal/domain"
+	"github.com/totegamma/concrnt-playground/internal/present/rest/presenter"
+	"github.com/totegamma/concrnt-playground/internal/service"
+)
+
+// Realtime protocol
+//
+// Clients send concrnt.RealtimeRequest messages as JSON text frames:
+//
+//	{"type": "listen", "id": "1", "prefixes": ["cc://..."], "since": "<event id>"}
+//	{"type": "subscribe", "id": "2", "prefixes": ["cc://..."], "since": "<event id>"}
+//	{"type": "unsubscribe", "id": "3", "prefixes": ["cc://..."]}
+//	{"type": "h"}
+//
+// listen replaces the whole prefix set, subscribe and unsubscribe change it
+// incrementally. since is optional and replays retained events after it.
+// Every listen/subscribe/unsubscribe is answered with a RealtimeResponse of type
+// "ack" or "error" carrying the same id. Events are sent as concrnt.Event.
+// The server sends websocket pings and closes connections which neither
+// answer them nor send anything within realtimePongWait. Events are queued
+// per connection; with the disconnect overflow policy a connection whose
+// queue fills up is closed with code 1013 (try again later) and should
+// reconnect with since set to the last event ID it received.
+const realtimeProtocolVersion = "1.1"
+
+const (
+	realtimePingInterval = 30 * time.Second
+	realtimePongWait     = 60 * time.Second
+	realtimeWriteWait    = 10 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+func (h *Handler) handleRealtime(c echo.Context) error {
+	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		slog.Error(
+			"Failed to upgrade WebSocket",
+			slog.String("error", err.Error()),
+			slog.String("module", "socket"),
+		)
+		return err
+	}
+	defer func() {
+		ws.Close()
+	}()
+
+	input := make(chan service.RealtimeRequest)
+	queue := h.signal.NewEventQueue()
+	defer logQueueStats(c.Request().Context(), "socket", queue)
+
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+
+	go h.signal.Realtime(ctx, input, queue, h.eventFilter(ctx))
+
+	quit := make(chan struct{})
+	replies := make(chan concrnt.RealtimeResponse)
+
+	ws.SetReadDeadline(time.Now().Add(realtimePongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(realtimePongWait))
+	})
+
+	go func() {
+		defer close(quit)
+		for {
+			var req concrnt.RealtimeRequest
+			err := ws.ReadJSON(&req)
+			if err != nil {
+
+				wsErr, ok := err.(*websocket.CloseError)
+				if ok {
+					if !(wsErr.Code == websocket.CloseNormalClosure || wsErr.Code == websocket.CloseGoingAway) {
+						slog.DebugContext(
+							ctx, "WebSocket closed",
+							slog.String("error", wsErr.Error()),
+							slog.String("module", "socket"),
+						)
+					}
+				} else {
+					slog.ErrorContext(
+						ctx, "Error reading message",
+						slog.String("error", err.Error()),
+						slog.String("module", "socket"),
+					)
+				}
+
+				return
+			}
+			ws.SetReadDeadline(time.Now().Add(realtimePongWait))
+
+			var reply concrnt.RealtimeResponse
+			switch req.Type {
+			case service.RealtimeListen, service.RealtimeSubscribe, service.RealtimeUnsubscribe:
+				result := make(chan error, 1)
+				select {
+				case input <- service.RealtimeRequest{
+					Type:     req.Type,
+					Prefixes: req.Prefixes,
+					Since:    req.Since,
+					Result:   result,
+				}:
+				case <-ctx.Done():
+					return
+				}
+
+				var err error
+				select {
+				case err = <-result:
+				case <-ctx.Done():
+					return
+				}
+
+				if err != nil {
+					reply = concrnt.RealtimeResponse{Type: "error", ID: req.ID, Error: err.Error()}
+				} else {
+					reply = concrnt.RealtimeResponse{Type: "ack", ID: req.ID}
+				}
+
+				slog.DebugContext(
+					ctx, fmt.Sprintf("Socket %s: %s (since: %s)", req.Type, req.Prefixes, req.Since),
+					slog.String("module", "socket"),
+				)
+			case "h": // heartbeat
+				continue
+			default:
+				slog.InfoContext(
+					ctx, "Unknown request type",
+					slog.String("type", req.Type),
+					slog.String("module", "socket"),
+				)
+				reply = concrnt.RealtimeResponse{Type: "error", ID: req.ID, Error: "unknown request type: " + req.Type}
+			}
+
+			select {
+			case replies <- reply:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(realtimePingInterval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case <-quit:
+			return nil
+		case <-queue.Overflow():
+			slog.InfoContext(
+				ctx, "Closing slow consumer",
+				slog.String("module", "socket"),
+			)
+			ws.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "send queue overflow"),
+				time.Now().Add(realtimeWriteWait),
+			)
+			return nil
+		case <-ticker.C:
+			err = ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(realtimeWriteWait))
+		case reply := <-replies:
+			ws.SetWriteDeadline(time.Now().Add(realtimeWriteWait))
+			err = ws.WriteJSON(reply)
+		case <-queue.Ready():
+			for {
+				event, ok := queue.Pop()
+				if !ok {
+					break
+				}
+				ws.SetWriteDeadline(time.Now().Add(realtimeWriteWait))
+				err = ws.WriteJSON(event)
+				if err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			slog.ErrorContext(
+				ctx, "Error writing message",
+				slog.String("error", err.Error()),
+				slog.String("module", "socket"),
+			)
+			return nil
+		}
+	}
+}
+
+// handleRealtimeSSE streams the same events as handleRealtime as text/event-stream.
+// The event ID is sent as the SSE id, so reconnecting clients resume through Last-Event-ID.
+func (h *Handler) handleRealtimeSSE(c echo.Context) error {
+
+	prefixesStr := c.QueryParam("prefixes")
+	if prefixesStr == "" {
+		return presenter.BadRequestMessage(c, "prefixes parameter is required")
+	}
+	prefixes := strings.Split(prefixesStr, ",")
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			return presenter.BadRequestMessage(c, "invalid prefixes parameter")
+		}
+	}
+
+	since := c.Request().Header.Get("Last-Event-ID")
+	if since == "" {
+		since = c.QueryParam("since")
+	}
+
+	input := make(chan service.RealtimeRequest)
+	queue := h.signal.NewEventQueue()
+	defer logQueueStats(c.Request().Context(), "sse", queue)
+
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+
+	go h.signal.Realtime(ctx, input, queue, h.eventFilter(ctx))
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	rc := http.NewResponseController(res)
+
+	// listen and replay in one request, so that live events are only delivered after the replay.
+	// The replay sends events while the request is processed, so it has to run concurrently
+	// with the write loop below.
+	result := make(chan error, 1)
+	go func() {
+		select {
+		case input <- service.RealtimeRequest{
+			Type:     service.RealtimeListen,
+			Prefixes: prefixes,
+			Since:    since,
+			Result:   result,
+		}:
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(realtimePingInterval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-queue.Overflow():
+			slog.InfoContext(
+				ctx, "Closing slow consumer",
+				slog.String("module", "sse"),
+			)
+			return nil
+		case err := <-result:
+			if err != nil {
+				slog.ErrorContext(
+					ctx, "Error listening to prefixes",
+					slog.String("error", err.Error()),
+					slog.String("module", "sse"),
+				)
+				return nil
+			}
+			continue
+		case <-ticker.C:
+			rc.SetWriteDeadline(time.Now().Add(realtimeWriteWait))
+			_, err = fmt.Fprint(res, ": ping\n\n")
+		case <-queue.Ready():
+			for {
+				event, ok := queue.Pop()
+				if !ok {
+					break
+				}
+				rc.SetWriteDeadline(time.Now().Add(realtimeWriteWait))
+				err = writeSSEEvent(res, event)
+				if err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			slog.ErrorContext(
+				ctx, "Error writing message",
+				slog.String("error", err.Error()),
+				slog.String("module", "sse"),
+			)
+			return nil
+		}
+		res.Flush()
+	}
+}
+
+func writeSSEEvent(w io.Writer, event concrnt.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if event.ID != "" {
+		_, err = fmt.Fprintf(w, "id: %s\n", event.ID)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+	return err
+}
+
+// eventFilter restricts events to what the requester identified by AuthMiddleware may read.
+func (h *Handler) eventFilter(ctx context.Context) service.EventFilter {
+	requester, _ := ctx.Value(domain.RequesterIdCtxKey).(string)
+	return func(ctx context.Context, event concrnt.Event) concrnt.Event {
+		return h.realtime.FilterEvent(ctx, requester, event)
+	}
+}
+
+// logQueueStats reports the delivery statistics of a finished connection.
+func logQueueStats(ctx context.Context, module string, queue *service.EventQueue) {
+	stats := queue.Stats()
+	slog.InfoContext(
+		ctx, "Realtime connection closed",
+		slog.Uint64("enqueued", stats.Enqueued),
+		slog.Uint64("delivered", stats.Delivered),
+		slog.Uint64("dropped", stats.Dropped),
+		slog.Uint64("coalesced", stats.Coalesced),
+		slog.Int("maxDepth", stats.MaxDepth),
+		slog.Bool("overflowed", stats.Overflowed),
+		slog.String("module", module),
+	)
+}
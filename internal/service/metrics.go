@@ -0,0 +1,38 @@
+package service
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	socketConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cc_socket_connections",
+		Help: "Number of active realtime sessions",
+	})
+	queueEnqueued = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cc_socket_events_enqueued_total",
+		Help: "Number of realtime events queued for delivery",
+	})
+	queueDelivered = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cc_socket_events_delivered_total",
+		Help: "Number of realtime events handed to connection writers",
+	})
+	queueDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cc_socket_events_dropped_total",
+		Help: "Number of realtime events dropped because a send queue was full",
+	}, []string{"policy"})
+	queueCoalesced = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cc_socket_events_coalesced_total",
+		Help: "Number of realtime events coalesced into an already queued event",
+	})
+	queueOverflowDisconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cc_socket_overflow_disconnects_total",
+		Help: "Number of realtime connections closed as slow consumers",
+	})
+	queueMaxDepth = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cc_socket_queue_max_depth",
+		Help:    "Maximum send queue depth reached by each realtime session",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	})
+)
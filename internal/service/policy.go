@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+
+	"github.com/totegamma/concrnt-playground"
+	"github.com/totegamma/concrnt-playground/client"
+	"github.com/totegamma/concrnt-playground/policy"
+)
+
+type PolicyService struct {
+	client *client.Client
+	cache  *cache.Cache
+}
+
+func NewPolicyService(cl *client.Client) *PolicyService {
+	return &PolicyService{
+		client: cl,
+		cache:  cache.New(10*time.Minute, 15*time.Minute),
+	}
+}
+
+// Evaluate reports whether action is allowed under all of the given policies.
+// An empty policy list allows everything.
+func (s *PolicyService) Evaluate(ctx context.Context, policies []concrnt.Policy, rctx policy.RequestContext, action string) (bool, error) {
+	ctx, span := tracer.Start(ctx, "Policy.Service.Evaluate")
+	defer span.End()
+
+	conclusions := make([]policy.Conclusion, 0, len(policies))
+	defaultAllow := true
+
+	for _, p := range policies {
+		doc, err := s.getPolicyDocument(ctx, p.URL)
+		if err != nil {
+			span.RecordError(err)
+			return false, err
+		}
+
+		params := map[string]any{}
+		if p.Params != nil {
+			err := json.Unmarshal([]byte(*p.Params), &params)
+			if err != nil {
+				span.RecordError(err)
+				return false, fmt.Errorf("invalid policy params: %w", err)
+			}
+		}
+		rctx.Params = params
+
+		allow := true
+		if version, ok := doc.Versions[policy.Version]; ok {
+			if d, ok := version.Defaults[action]; ok {
+				allow = d
+			}
+		}
+		if p.Defaults != nil {
+			var defaults map[string]bool
+			err := json.Unmarshal([]byte(*p.Defaults), &defaults)
+			if err != nil {
+				span.RecordError(err)
+				return false, fmt.Errorf("invalid policy defaults: %w", err)
+			}
+			if d, ok := defaults[action]; ok {
+				allow = d
+			}
+		}
+		defaultAllow = defaultAllow && allow
+
+		conclusion, err := policy.EvaluatePolicy(*doc, rctx, action)
+		if err != nil {
+			span.RecordError(err)
+			return false, err
+		}
+		conclusions = append(conclusions, conclusion)
+	}
+
+	return policy.SummerizeConclusion(conclusions, defaultAllow), nil
+}
+
+func (s *PolicyService) getPolicyDocument(ctx context.Context, url string) (*policy.PolicyDocument, error) {
+
+	if cached, found := s.cache.Get(url); found {
+		return cached.(*policy.PolicyDocument), nil
+	}
+
+	var doc policy.PolicyDocument
+	err := s.client.FetchJSON(ctx, url, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch policy %s: %w", url, err)
+	}
+
+	s.cache.Set(url, &doc, cache.DefaultExpiration)
+	return &doc, nil
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/totegamma/concrnt-playground"
+)
+
+// OverflowPolicy decides what an EventQueue does with a new event when it is full.
+type OverflowPolicy string
+
+const (
+	// OverflowDropOldest discards the oldest queued event.
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowCoalesce drops a queued event of the same type and URI in favour of the new one,
+	// which goes to the tail so that event IDs stay in order. It falls back to dropping the oldest event.
+	OverflowCoalesce OverflowPolicy = "coalesce"
+	// OverflowDisconnect marks the queue as overflowed so that the consumer is disconnected.
+	OverflowDisconnect OverflowPolicy = "disconnect"
+)
+
+const defaultQueueSize = 256
+
+// EventQueueStats are per-connection delivery statistics.
+type EventQueueStats struct {
+	Enqueued   uint64
+	Delivered  uint64
+	Dropped    uint64
+	Coalesced  uint64
+	MaxDepth   int
+	Overflowed bool
+}
+
+// EventQueue is a bounded queue between a realtime session and its consumer.
+// Push never blocks, so a slow consumer cannot stall the subscription.
+type EventQueue struct {
+	mu       sync.Mutex
+	items    []concrnt.Event
+	size     int
+	policy   OverflowPolicy
+	ready    chan struct{}
+	space    chan struct{}
+	overflow chan struct{}
+	stats    EventQueueStats
+}
+
+func NewEventQueue(size int, policy OverflowPolicy) *EventQueue {
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	switch policy {
+	case OverflowDropOldest, OverflowCoalesce, OverflowDisconnect:
+	default:
+		policy = OverflowDropOldest
+	}
+	return &EventQueue{
+		items:    make([]concrnt.Event, 0, size),
+		size:     size,
+		policy:   policy,
+		ready:    make(chan struct{}, 1),
+		space:    make(chan struct{}, 1),
+		overflow: make(chan struct{}),
+	}
+}
+
+// Push enqueues the event, applying the overflow policy when the queue is full.
+func (q *EventQueue) Push(event concrnt.Event) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.stats.Overflowed {
+		return
+	}
+
+	if len(q.items) >= q.size {
+		switch q.policy {
+		case OverflowDisconnect:
+			q.stats.Overflowed = true
+			close(q.overflow)
+			queueOverflowDisconnects.Inc()
+			return
+		case OverflowCoalesce:
+			i := lastSameEvent(q.items, event)
+			if i >= 0 {
+				q.items = slices.Delete(q.items, i, i+1)
+				q.stats.Coalesced++
+				queueCoalesced.Inc()
+				break
+			}
+			fallthrough
+		default:
+			q.items = q.items[1:]
+			q.stats.Dropped++
+			queueDropped.WithLabelValues(string(q.policy)).Inc()
+		}
+	}
+
+	q.items = append(q.items, event)
+	q.stats.Enqueued++
+	queueEnqueued.Inc()
+	if len(q.items) > q.stats.MaxDepth {
+		q.stats.MaxDepth = len(q.items)
+	}
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// lastSameEvent returns the index of the newest item with the type and URI of event, or -1.
+func lastSameEvent(items []concrnt.Event, event concrnt.Event) int {
+	for i := len(items) - 1; i >= 0; i-- {
+		if items[i].Type == event.Type && items[i].URI == event.URI {
+			return i
+		}
+	}
+	return -1
+}
+
+// PushWait enqueues the event, waiting for free space instead of applying the overflow policy.
+// It is used for replays, which may legitimately be larger than the queue.
+func (q *EventQueue) PushWait(ctx context.Context, event concrnt.Event) error {
+	for {
+		q.mu.Lock()
+		full := len(q.items) >= q.size
+		q.mu.Unlock()
+		if !full {
+			q.Push(event)
+			return nil
+		}
+
+		select {
+		case <-q.space:
+		case <-q.overflow:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Pop dequeues the oldest event. It returns false if the queue is empty.
+func (q *EventQueue) Pop() (concrnt.Event, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) == 0 {
+		return concrnt.Event{}, false
+	}
+
+	event := q.items[0]
+	q.items[0] = concrnt.Event{}
+	q.items = q.items[1:]
+	q.stats.Delivered++
+	queueDelivered.Inc()
+
+	select {
+	case q.space <- struct{}{}:
+	default:
+	}
+
+	return event, true
+}
+
+// Ready is signaled when events are pushed. Consumers should Pop until empty on each signal.
+func (q *EventQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Overflow is closed when the queue overflowed under OverflowDisconnect.
+func (q *EventQueue) Overflow() <-chan struct{} {
+	return q.overflow
+}
+
+func (q *EventQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+func (q *EventQueue) Stats() EventQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stats
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/totegamma/concrnt-playground"
+)
+
+func TestEventQueueDropOldest(t *testing.T) {
+	q := NewEventQueue(2, OverflowDropOldest)
+	q.Push(concrnt.Event{ID: "1-0"})
+	q.Push(concrnt.Event{ID: "2-0"})
+	q.Push(concrnt.Event{ID: "3-0"})
+
+	first, _ := q.Pop()
+	second, _ := q.Pop()
+	if first.ID != "2-0" || second.ID != "3-0" {
+		t.Fatalf("unexpected order: %s, %s", first.ID, second.ID)
+	}
+	if _, ok := q.Pop(); ok {
+		t.Fatal("queue should be empty")
+	}
+	if q.Stats().Dropped != 1 {
+		t.Fatalf("expected 1 dropped event, got %d", q.Stats().Dropped)
+	}
+}
+
+func TestEventQueueCoalesce(t *testing.T) {
+	q := NewEventQueue(2, OverflowCoalesce)
+	q.Push(concrnt.Event{ID: "1-0", Type: "associated", URI: "cc://a/post"})
+	q.Push(concrnt.Event{ID: "2-0", Type: "created", URI: "cc://a/other"})
+	q.Push(concrnt.Event{ID: "3-0", Type: "associated", URI: "cc://a/post"})
+
+	first, _ := q.Pop()
+	second, _ := q.Pop()
+	if first.ID != "2-0" || second.ID != "3-0" {
+		t.Fatalf("expected 2-0 then the coalesced event 3-0, got %s and %s", first.ID, second.ID)
+	}
+	if q.Stats().Coalesced != 1 || q.Stats().Dropped != 0 {
+		t.Fatalf("unexpected stats: %+v", q.Stats())
+	}
+}
+
+func TestEventQueueDisconnect(t *testing.T) {
+	q := NewEventQueue(1, OverflowDisconnect)
+	q.Push(concrnt.Event{ID: "1-0"})
+	q.Push(concrnt.Event{ID: "2-0"})
+
+	select {
+	case <-q.Overflow():
+	default:
+		t.Fatal("overflow should be signaled")
+	}
+	if !q.Stats().Overflowed {
+		t.Fatal("stats should report overflow")
+	}
+}
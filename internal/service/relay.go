@@ -0,0 +1,577 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/totegamma/concrnt-playground"
+	"github.com/totegamma/concrnt-playground/client"
+	"github.com/totegamma/concrnt-playground/internal/domain"
+)
+
+const (
+	relayMinBackoff = time.Second
+	relayMaxBackoff = time.Minute
+	relayWriteWait  = 10 * time.Second
+	relayReadWait   = 90 * time.Second
+	// wanted prefixes are announced with an expiry, so those of crashed instances go away
+	relayWantTTL     = 30 * time.Second
+	relayWantRefresh = 10 * time.Second
+)
+
+// Relay subscribes to remote servers for prefixes owned by remote entities.
+// Acquire returns the prefixes it has taken a reference on; exactly those
+// must be passed to Release once they are no longer listened to.
+type Relay interface {
+	Acquire(ctx context.Context, prefixes []string) []string
+	Release(prefixes []string)
+}
+
+// Elector grants named leaderships to at most one instance at a time.
+// Run campaigns until ctx is done or lead returns, and calls lead with a
+// context that is canceled as soon as the leadership is lost.
+type Elector interface {
+	Run(ctx context.Context, name string, lead func(ctx context.Context))
+}
+
+// RelayService relays realtime events of remote prefixes into the local broker.
+// Every instance announces the remote prefixes its listeners want in Redis and
+// campaigns for the remote server. Only the leader holds the upstream connection,
+// subscribed to the union of all announcements; since events are republished
+// through Redis, every instance receives them.
+type RelayService struct {
+	config  *domain.Config
+	client  *client.Client
+	signal  *SignalService
+	elector Elector
+	dialer  *websocket.Dialer
+	mu      sync.Mutex
+	homes   map[string]string
+	demands map[string]*demand
+}
+
+// demand is the local interest in one remote server.
+type demand struct {
+	refs   map[string]int
+	cancel context.CancelFunc
+}
+
+func NewRelayService(config *domain.Config, cl *client.Client, signal *SignalService, elector Elector) *RelayService {
+	return &RelayService{
+		config:  config,
+		client:  cl,
+		signal:  signal,
+		elector: elector,
+		dialer:  websocket.DefaultDialer,
+		homes:   make(map[string]string),
+		demands: make(map[string]*demand),
+	}
+}
+
+// Start keeps the announcements of this instance alive until ctx is done.
+func (r *RelayService) Start(ctx context.Context) {
+	ticker := time.NewTicker(relayWantRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		r.mu.Lock()
+		wants := make(map[string][]string, len(r.demands))
+		for home, d := range r.demands {
+			for prefix := range d.refs {
+				wants[home] = append(wants[home], prefix)
+			}
+		}
+		r.mu.Unlock()
+
+		for home, prefixes := range wants {
+			err := r.announce(ctx, home, prefixes, false)
+			if err != nil {
+				slog.WarnContext(
+					ctx, "Failed to refresh relay announcement",
+					slog.String("server", home),
+					slog.String("error", err.Error()),
+					slog.String("module", "relay"),
+				)
+			}
+		}
+	}
+}
+
+func (r *RelayService) Acquire(ctx context.Context, prefixes []string) []string {
+	ctx, span := tracer.Start(ctx, "Relay.Service.Acquire")
+	defer span.End()
+
+	var acquired []string
+	added := make(map[string][]string)
+	for _, prefix := range prefixes {
+		home, err := r.resolveHome(ctx, prefix)
+		if err != nil {
+			span.RecordError(err)
+			slog.WarnContext(
+				ctx, "Failed to resolve home server",
+				slog.String("prefix", prefix),
+				slog.String("error", err.Error()),
+				slog.String("module", "relay"),
+			)
+			continue
+		}
+		if home == "" || home == r.config.FQDN {
+			continue
+		}
+
+		r.mu.Lock()
+		r.homes[prefix] = home
+		d, ok := r.demands[home]
+		if !ok {
+			campaignCtx, cancel := context.WithCancel(context.Background())
+			d = &demand{
+				refs:   make(map[string]int),
+				cancel: cancel,
+			}
+			r.demands[home] = d
+			go r.elector.Run(campaignCtx, "relay:"+home, func(ctx context.Context) {
+				r.lead(ctx, home)
+			})
+		}
+		d.refs[prefix]++
+		r.mu.Unlock()
+
+		added[home] = append(added[home], prefix)
+		acquired = append(acquired, prefix)
+	}
+
+	for home, prefixes := range added {
+		err := r.announce(ctx, home, prefixes, true)
+		if err != nil {
+			span.RecordError(err)
+			slog.WarnContext(
+				ctx, "Failed to announce relay prefixes",
+				slog.String("server", home),
+				slog.String("error", err.Error()),
+				slog.String("module", "relay"),
+			)
+		}
+	}
+
+	return acquired
+}
+
+// Release drops the local references. Announcements are left to expire,
+// as other instances may still want the same prefixes.
+func (r *RelayService) Release(prefixes []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, prefix := range prefixes {
+		home, ok := r.homes[prefix]
+		if !ok {
+			continue
+		}
+		d, ok := r.demands[home]
+		if !ok {
+			continue
+		}
+		d.refs[prefix]--
+		if d.refs[prefix] <= 0 {
+			delete(d.refs, prefix)
+		}
+		if len(d.refs) == 0 {
+			// stop campaigning; a leader steps down so that another interested instance takes over
+			d.cancel()
+			delete(r.demands, home)
+		}
+	}
+}
+
+// announce records that this instance wants prefixes of home and optionally wakes up the leader.
+func (r *RelayService) announce(ctx context.Context, home string, prefixes []string, notify bool) error {
+	expiry := float64(time.Now().Add(relayWantTTL).UnixMilli())
+	members := make([]redis.Z, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		members = append(members, redis.Z{Score: expiry, Member: prefix})
+	}
+
+	pipe := r.signal.rdb.Pipeline()
+	pipe.ZAddGT(ctx, relayWantsKey(home), members...)
+	if notify {
+		pipe.Publish(ctx, relayChangedChannel(home), "")
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// wanted returns the prefixes of home any instance currently wants.
+func (r *RelayService) wanted(ctx context.Context, home string) (map[string]struct{}, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	key := relayWantsKey(home)
+
+	pipe := r.signal.rdb.Pipeline()
+	pipe.ZRemRangeByScore(ctx, key, "-inf", "("+now)
+	members := pipe.ZRangeByScore(ctx, key, &redis.ZRangeBy{Min: now, Max: "+inf"})
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]struct{}, len(members.Val()))
+	for _, prefix := range members.Val() {
+		result[prefix] = struct{}{}
+	}
+	return result, nil
+}
+
+// lead holds the upstream connection of home while this instance is the leader for it.
+func (r *RelayService) lead(ctx context.Context, home string) {
+	up := &upstream{
+		relay:   r,
+		home:    home,
+		changed: make(chan struct{}, 1),
+	}
+
+	pubsub := r.signal.rdb.Subscribe(ctx, relayChangedChannel(home))
+	defer pubsub.Close()
+
+	go func() {
+		// poll as well, since expired announcements are not notified
+		ticker := time.NewTicker(relayWantRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pubsub.Channel():
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			up.notify()
+		}
+	}()
+
+	up.run(ctx)
+}
+
+// resolveHome returns the domain of the server which stores the resources under prefix.
+func (r *RelayService) resolveHome(ctx context.Context, prefix string) (string, error) {
+
+	r.mu.Lock()
+	home, ok := r.homes[prefix]
+	r.mu.Unlock()
+	if ok {
+		return home, nil
+	}
+
+	owner, _, hint, err := concrnt.ParseCCURIWithHint(prefix)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case owner == "":
+		return "", nil
+	case concrnt.IsCCID(owner):
+		entity, err := r.client.GetEntity(ctx, owner, hint)
+		if err != nil {
+			return "", err
+		}
+		return entity.Domain, nil
+	case concrnt.IsCSID(owner):
+		if owner == r.config.CSID {
+			return r.config.FQDN, nil
+		}
+		wkc, err := r.client.GetServer(ctx, owner, hint)
+		if err != nil {
+			return "", err
+		}
+		return wkc.Domain, nil
+	default:
+		return owner, nil
+	}
+}
+
+func relayWantsKey(home string) string {
+	return "concrnt:relay:wants:" + home
+}
+
+func relayChangedChannel(home string) string {
+	return "concrnt:relay:changed:" + home
+}
+
+// relayCursorKey stores the last relayed event ID, so that a new leader resumes where the previous one stopped.
+func relayCursorKey(home string) string {
+	return "concrnt:relay:cursor:" + home
+}
+
+// upstream is the connection to one remote server's realtime endpoint.
+type upstream struct {
+	relay   *RelayService
+	home    string
+	changed chan struct{}
+	seq     int
+
+	// mu guards prefixes, the prefixes events are accepted for
+	mu       sync.Mutex
+	prefixes map[string]struct{}
+}
+
+func (u *upstream) notify() {
+	select {
+	case u.changed <- struct{}{}:
+	default:
+	}
+}
+
+// run keeps the upstream connected until ctx is done, resuming from the
+// last relayed event after reconnects.
+func (u *upstream) run(ctx context.Context) {
+	backoff := relayMinBackoff
+
+	for {
+		connected, err := u.serve(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.WarnContext(
+				ctx, "Upstream realtime connection lost",
+				slog.String("server", u.home),
+				slog.String("error", err.Error()),
+				slog.String("module", "relay"),
+			)
+		}
+		if connected {
+			backoff = relayMinBackoff
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, relayMaxBackoff)
+	}
+}
+
+// serve runs one upstream connection. It reports whether the connection was established.
+func (u *upstream) serve(ctx context.Context) (bool, error) {
+
+	wkc, err := u.relay.client.GetServer(ctx, u.home, "")
+	if err != nil {
+		return false, err
+	}
+	endpoint, ok := wkc.Endpoints["net.concrnt.realtime"]
+	if !ok {
+		return false, fmt.Errorf("server %s does not provide realtime endpoint", u.home)
+	}
+	// servers advertising a protocol version understand incremental subscribe/unsubscribe
+	incremental := endpoint.Version != ""
+
+	since, err := u.relay.signal.rdb.Get(ctx, relayCursorKey(u.home)).Result()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+
+	ws, _, err := u.relay.dialer.DialContext(ctx, "wss://"+wkc.Domain+endpoint.Template, nil)
+	if err != nil {
+		return false, err
+	}
+	defer ws.Close()
+
+	slog.InfoContext(
+		ctx, "Upstream realtime connected",
+		slog.String("server", u.home),
+		slog.String("module", "relay"),
+	)
+
+	// the remote server pings periodically; treat a silent connection as dead
+	ws.SetReadDeadline(time.Now().Add(relayReadWait))
+	ws.SetPingHandler(func(data string) error {
+		ws.SetReadDeadline(time.Now().Add(relayReadWait))
+		return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(relayWriteWait))
+	})
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- u.read(ctx, ws)
+	}()
+
+	sent := make(map[string]struct{})
+	for {
+		err := u.sync(ctx, ws, sent, incremental, since)
+		if err != nil {
+			ws.Close()
+			<-errs
+			return true, err
+		}
+		since = ""
+
+		select {
+		case <-u.changed:
+		case err := <-errs:
+			return true, err
+		case <-ctx.Done():
+			ws.Close()
+			<-errs
+			return true, nil
+		}
+	}
+}
+
+// sync sends the requests needed to make the remote subscription match the wanted prefixes.
+func (u *upstream) sync(ctx context.Context, ws *websocket.Conn, sent map[string]struct{}, incremental bool, since string) error {
+
+	current, err := u.relay.wanted(ctx, u.home)
+	if err != nil {
+		return err
+	}
+	var added, removed []string
+	for prefix := range current {
+		if _, ok := sent[prefix]; !ok {
+			added = append(added, prefix)
+		}
+	}
+	for prefix := range sent {
+		if _, ok := current[prefix]; !ok {
+			removed = append(removed, prefix)
+		}
+	}
+
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	// events of removed prefixes still in flight are dropped from now on
+	u.mu.Lock()
+	u.prefixes = current
+	u.mu.Unlock()
+
+	var requests []concrnt.RealtimeRequest
+	if incremental {
+		if len(added) > 0 {
+			requests = append(requests, u.request(RealtimeSubscribe, added, since))
+		}
+		if len(removed) > 0 {
+			requests = append(requests, u.request(RealtimeUnsubscribe, removed, ""))
+		}
+	} else {
+		all := make([]string, 0, len(current))
+		for prefix := range current {
+			all = append(all, prefix)
+		}
+		requests = append(requests, u.request(RealtimeListen, all, since))
+	}
+
+	for _, req := range requests {
+		ws.SetWriteDeadline(time.Now().Add(relayWriteWait))
+		err := ws.WriteJSON(req)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, prefix := range added {
+		sent[prefix] = struct{}{}
+	}
+	for _, prefix := range removed {
+		delete(sent, prefix)
+	}
+
+	return nil
+}
+
+func (u *upstream) request(typ string, prefixes []string, since string) concrnt.RealtimeRequest {
+	u.seq++
+	return concrnt.RealtimeRequest{
+		Type:     typ,
+		ID:       strconv.Itoa(u.seq),
+		Prefixes: prefixes,
+		Since:    since,
+	}
+}
+
+// read republishes upstream events into the local broker until the connection fails.
+func (u *upstream) read(ctx context.Context, ws *websocket.Conn) error {
+	for {
+		// responses and events share the connection, so decode into a union of both
+		var msg struct {
+			concrnt.Event
+			Error string `json:"error,omitempty"`
+		}
+		err := ws.ReadJSON(&msg)
+		if err != nil {
+			return err
+		}
+		ws.SetReadDeadline(time.Now().Add(relayReadWait))
+		event := msg.Event
+
+		switch event.Type {
+		case "ack":
+			continue
+		case "error":
+			slog.WarnContext(
+				ctx, "Upstream rejected request",
+				slog.String("server", u.home),
+				slog.String("id", event.ID),
+				slog.String("error", msg.Error),
+				slog.String("module", "relay"),
+			)
+			continue
+		}
+
+		// servers before the channel was carried publish on the event URI
+		channel := event.Channel
+		if channel == "" {
+			channel = event.URI
+		}
+		if !u.accepts(channel) {
+			slog.WarnContext(
+				ctx, "Dropped upstream event outside of the wanted prefixes",
+				slog.String("server", u.home),
+				slog.String("channel", channel),
+				slog.String("module", "relay"),
+			)
+			continue
+		}
+
+		upstreamID := event.ID
+
+		err = u.relay.signal.PublishRelayed(ctx, channel, event)
+		if err != nil {
+			slog.ErrorContext(
+				ctx, "Failed to republish upstream event",
+				slog.String("server", u.home),
+				slog.String("error", err.Error()),
+				slog.String("module", "relay"),
+			)
+			continue
+		}
+
+		if upstreamID != "" {
+			u.relay.signal.rdb.Set(ctx, relayCursorKey(u.home), upstreamID, u.relay.signal.options.EventRetention)
+		}
+	}
+}
+
+// accepts reports whether channel is under one of the prefixes this upstream was asked for.
+func (u *upstream) accepts(channel string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for prefix := range u.prefixes {
+		if strings.HasPrefix(channel, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -4,94 +4,429 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 
 	"github.com/totegamma/concrnt-playground"
 )
 
+const (
+	eventStreamKey        = "concrnt:events"
+	defaultEventRetention = 10 * time.Minute
+	replayBatchSize       = 256
+	eventStreamFieldChan  = "channel"
+	eventStreamFieldEvent = "event"
+)
+
 type SignalService struct {
-	rdb *redis.Client
+	rdb     *redis.Client
+	options SignalOptions
+	relay   Relay
+	hooks   []PublishHook
+}
+
+// PublishHook is called after an event of a commit to this server has been published on channel.
+type PublishHook func(ctx context.Context, channel string, event concrnt.Event)
+
+// SignalOptions tunes event retention and per-connection delivery.
+type SignalOptions struct {
+	EventRetention time.Duration
+	QueueSize      int
+	OverflowPolicy OverflowPolicy
 }
 
-func NewSignalService(redisClient *redis.Client) *SignalService {
+func NewSignalService(redisClient *redis.Client, options SignalOptions) *SignalService {
+	if options.EventRetention <= 0 {
+		options.EventRetention = defaultEventRetention
+	}
 	return &SignalService{
-		rdb: redisClient,
+		rdb:     redisClient,
+		options: options,
 	}
 }
 
+// SetRelay makes realtime sessions relay prefixes owned by remote servers through relay.
+// It must be called before the first session starts.
+func (s *SignalService) SetRelay(relay Relay) {
+	s.relay = relay
+}
+
+// NewEventQueue creates a send queue for one realtime connection with the configured size and policy.
+func (s *SignalService) NewEventQueue() *EventQueue {
+	return NewEventQueue(s.options.QueueSize, s.options.OverflowPolicy)
+}
+
+const (
+	// RealtimeListen replaces the whole set of prefixes.
+	RealtimeListen = "listen"
+	// RealtimeSubscribe adds prefixes to the set.
+	RealtimeSubscribe = "subscribe"
+	// RealtimeUnsubscribe removes prefixes from the set.
+	RealtimeUnsubscribe = "unsubscribe"
+)
+
+// RealtimeRequest changes the set of prefixes a realtime session listens to.
+// When Since is set, retained events published after that event ID are
+// replayed for the requested prefixes before live delivery continues.
+type RealtimeRequest struct {
+	Type     string
+	Prefixes []string
+	Since    string
+	// Result receives the outcome of the request if not nil.
+	// It must be buffered so that the session never blocks on it.
+	Result chan<- error
+}
+
+// OnPublish registers hook to be called for every published event.
+// It must be called before events are published.
+func (s *SignalService) OnPublish(hook PublishHook) {
+	s.hooks = append(s.hooks, hook)
+}
+
+// Publish appends the event to the retained event stream and then broadcasts it.
+// The stream entry ID is used as the event ID, so IDs are monotonically ordered.
+// Callers publish after committing the change, so that hooks and subscribers see it.
 func (s *SignalService) Publish(ctx context.Context, channel string, event concrnt.Event) error {
+	err := s.broadcast(ctx, channel, &event)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range s.hooks {
+		hook(ctx, channel, event)
+	}
+
+	return nil
+}
+
+// PublishRelayed delivers an event relayed from a remote server like Publish, but without
+// running the publish hooks, which are meant for commits to this server.
+func (s *SignalService) PublishRelayed(ctx context.Context, channel string, event concrnt.Event) error {
+	return s.broadcast(ctx, channel, &event)
+}
+
+// broadcast appends the event to the retained event stream, sets its ID and publishes it on channel.
+func (s *SignalService) broadcast(ctx context.Context, channel string, event *concrnt.Event) error {
 
+	event.ID = ""
+	event.Channel = channel
 	jsonstr, err := json.Marshal(event)
 	if err != nil {
 		return err
 	}
 
-	err = s.rdb.Publish(ctx, channel, jsonstr).Err()
+	minID := strconv.FormatInt(time.Now().Add(-s.options.EventRetention).UnixMilli(), 10) + "-0"
+	id, err := s.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: eventStreamKey,
+		MinID:  minID,
+		Approx: true,
+		Values: map[string]any{
+			eventStreamFieldChan:  channel,
+			eventStreamFieldEvent: jsonstr,
+		},
+	}).Result()
 	if err != nil {
 		return err
+	}
 
+	event.ID = id
+	jsonstr, err = json.Marshal(event)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return s.rdb.Publish(ctx, channel, jsonstr).Err()
 }
 
-func (s *SignalService) Realtime(ctx context.Context, request <-chan []string, response chan<- concrnt.Event) {
+// EventFilter rewrites an event into what the consumer of a session is allowed to see.
+type EventFilter func(ctx context.Context, event concrnt.Event) concrnt.Event
+
+// Realtime serves a realtime session until ctx is done or request is closed.
+// All prefixes of the session share one pattern subscription, which is
+// updated incrementally as requests arrive. Events are pushed to response
+// without blocking, so a slow consumer only affects its own queue.
+// If filter is not nil, every event passes through it before being queued.
+func (s *SignalService) Realtime(ctx context.Context, request <-chan RealtimeRequest, response *EventQueue, filter EventFilter) {
+
+	socketConnections.Inc()
+	defer socketConnections.Dec()
 
-	var cancel context.CancelFunc
-	events := make(chan concrnt.Event)
+	pubsub := s.rdb.PSubscribe(ctx)
+	defer pubsub.Close()
+	defer func() {
+		queueMaxDepth.Observe(float64(response.Stats().MaxDepth))
+	}()
+
+	session := &realtimeSession{
+		signal:   s,
+		pubsub:   pubsub,
+		prefixes: make(map[string]struct{}),
+		replayed: make(map[string]string),
+		relayed:  make(map[string]struct{}),
+		response: response,
+		filter:   filter,
+	}
+	defer session.releaseRelayed(session.relayed)
+
+	psch := pubsub.Channel()
 
 	for {
 		select {
-		case prefixes := <-request:
-			if cancel != nil {
-				cancel()
+		case req, ok := <-request:
+			if !ok {
+				return
 			}
-
-			patterns := make([]string, len(prefixes))
-			for i, prefix := range prefixes {
-				patterns[i] = prefix + "*"
+			err := session.apply(ctx, req)
+			if req.Result != nil {
+				req.Result <- err
 			}
 
-			var subctx context.Context
-			subctx, cancel = context.WithCancel(ctx)
-			go s.Subscribe(subctx, patterns, events)
-
-		case event := <-events:
-			response <- event
+		case msg := <-psch:
+			session.deliver(ctx, msg)
 
 		case <-ctx.Done():
-			if cancel != nil {
-				cancel()
-			}
 			return
 		}
 	}
 }
 
-func (s *SignalService) Subscribe(ctx context.Context, patterns []string, event chan<- concrnt.Event) error {
+type realtimeSession struct {
+	signal   *SignalService
+	pubsub   *redis.PubSub
+	prefixes map[string]struct{}
+	replayed map[string]string // prefix -> last event ID delivered by a replay
+	relayed  map[string]struct{}
+	lastID   string
+	response *EventQueue
+	filter   EventFilter
+}
+
+func (r *realtimeSession) apply(ctx context.Context, req RealtimeRequest) error {
 
-	if len(patterns) == 0 {
-		return nil
+	var added, removed []string
+
+	switch req.Type {
+	case RealtimeListen:
+		next := make(map[string]struct{}, len(req.Prefixes))
+		for _, prefix := range req.Prefixes {
+			next[prefix] = struct{}{}
+		}
+		for prefix := range r.prefixes {
+			if _, ok := next[prefix]; !ok {
+				removed = append(removed, prefix)
+			}
+		}
+		for prefix := range next {
+			if _, ok := r.prefixes[prefix]; !ok {
+				added = append(added, prefix)
+			}
+		}
+	case RealtimeSubscribe:
+		if len(req.Prefixes) == 0 {
+			return fmt.Errorf("prefixes are required")
+		}
+		for _, prefix := range req.Prefixes {
+			if _, ok := r.prefixes[prefix]; !ok {
+				added = append(added, prefix)
+			}
+		}
+	case RealtimeUnsubscribe:
+		if len(req.Prefixes) == 0 {
+			return fmt.Errorf("prefixes are required")
+		}
+		for _, prefix := range req.Prefixes {
+			if _, ok := r.prefixes[prefix]; ok {
+				removed = append(removed, prefix)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown request type: %s", req.Type)
 	}
 
-	pubsub := s.rdb.PSubscribe(ctx, patterns...)
-	defer pubsub.Close()
+	if len(removed) > 0 {
+		err := r.pubsub.PUnsubscribe(ctx, toPatterns(removed)...)
+		if err != nil {
+			return err
+		}
+		released := make(map[string]struct{})
+		for _, prefix := range removed {
+			delete(r.prefixes, prefix)
+			delete(r.replayed, prefix)
+			if _, ok := r.relayed[prefix]; ok {
+				released[prefix] = struct{}{}
+				delete(r.relayed, prefix)
+			}
+		}
+		r.releaseRelayed(released)
+	}
 
-	psch := pubsub.Channel()
+	if len(added) > 0 {
+		err := r.pubsub.PSubscribe(ctx, toPatterns(added)...)
+		if err != nil {
+			return err
+		}
+		for _, prefix := range added {
+			r.prefixes[prefix] = struct{}{}
+		}
+		if r.signal.relay != nil {
+			for _, prefix := range r.signal.relay.Acquire(ctx, added) {
+				r.relayed[prefix] = struct{}{}
+			}
+		}
+	}
+
+	if req.Since != "" && len(req.Prefixes) > 0 && req.Type != RealtimeUnsubscribe {
+		last, err := r.signal.replay(ctx, req.Prefixes, req.Since, r.response, r.filter)
+		if err != nil {
+			return fmt.Errorf("failed to replay events: %w", err)
+		}
+		for _, prefix := range req.Prefixes {
+			r.replayed[prefix] = last
+		}
+	}
+
+	return nil
+}
+
+func (r *realtimeSession) releaseRelayed(prefixes map[string]struct{}) {
+	if r.signal.relay == nil || len(prefixes) == 0 {
+		return
+	}
+	list := make([]string, 0, len(prefixes))
+	for prefix := range prefixes {
+		list = append(list, prefix)
+	}
+	r.signal.relay.Release(list)
+}
+
+func (r *realtimeSession) deliver(ctx context.Context, msg *redis.Message) {
+
+	var item concrnt.Event
+	err := json.Unmarshal([]byte(msg.Payload), &item)
+	if err != nil {
+		fmt.Println("failed to unmarshal event:", err)
+		return
+	}
+
+	if item.ID != "" {
+		// overlapping patterns deliver the same event once per pattern
+		if item.ID == r.lastID {
+			return
+		}
+
+		// skip events which were already delivered by a replay
+		for prefix, last := range r.replayed {
+			if !strings.HasPrefix(msg.Channel, prefix) {
+				continue
+			}
+			if !eventIDAfter(item.ID, last) {
+				return
+			}
+			delete(r.replayed, prefix)
+		}
+
+		r.lastID = item.ID
+	}
+
+	if r.filter != nil {
+		item = r.filter(ctx, item)
+	}
+
+	r.response.Push(item)
+}
+
+func toPatterns(prefixes []string) []string {
+	patterns := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		patterns[i] = prefix + "*"
+	}
+	return patterns
+}
 
+// replay sends retained events after since that match the prefixes and
+// returns the ID of the last stream entry it has read.
+func (s *SignalService) replay(ctx context.Context, prefixes []string, since string, queue *EventQueue, filter EventFilter) (string, error) {
+
+	last := since
 	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case msg := <-psch:
+		msgs, err := s.rdb.XRangeN(ctx, eventStreamKey, "("+last, "+", replayBatchSize).Result()
+		if err != nil {
+			return "", err
+		}
+
+		for _, msg := range msgs {
+			last = msg.ID
+
+			channel, _ := msg.Values[eventStreamFieldChan].(string)
+			if !hasAnyPrefix(channel, prefixes) {
+				continue
+			}
+
+			payload, _ := msg.Values[eventStreamFieldEvent].(string)
 			var item concrnt.Event
-			err := json.Unmarshal([]byte(msg.Payload), &item)
+			err := json.Unmarshal([]byte(payload), &item)
 			if err != nil {
 				fmt.Println("failed to unmarshal event:", err)
 				continue
 			}
-			event <- item
+			item.ID = msg.ID
+			if filter != nil {
+				item = filter(ctx, item)
+			}
+
+			err = queue.PushWait(ctx, item)
+			if err != nil {
+				return last, err
+			}
+		}
+
+		if len(msgs) < replayBatchSize {
+			return last, nil
 		}
 	}
 }
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventIDAfter reports whether the stream ID a is ordered after b.
+// Unparsable IDs are treated as newer so that they are never dropped.
+func eventIDAfter(a, b string) bool {
+	ams, aseq, ok := parseEventID(a)
+	if !ok {
+		return true
+	}
+	bms, bseq, ok := parseEventID(b)
+	if !ok {
+		return true
+	}
+	if ams != bms {
+		return ams > bms
+	}
+	return aseq > bseq
+}
+
+func parseEventID(id string) (uint64, uint64, bool) {
+	msStr, seqStr, found := strings.Cut(id, "-")
+	if !found {
+		return 0, 0, false
+	}
+	ms, err := strconv.ParseUint(msStr, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return ms, seq, true
+}
@@ -2,10 +2,14 @@ package usecase
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/concrnt/chunkline"
+
+	"github.com/totegamma/concrnt-playground"
+	"github.com/totegamma/concrnt-playground/internal/domain"
 )
 
 type ChunklineUsecase struct {
@@ -15,14 +19,21 @@ type ChunklineUsecase struct {
 
 // ChunklineRepository defines storage operations for chunkline timelines.
 type ChunklineRepository interface {
-	GetChunklineManifest(ctx context.Context, uri string) (*chunkline.Manifest, error)
+	GetChunklineManifest(ctx context.Context, uri string) (*concrnt.ChunklineManifest, error)
 	LookupLocalItrs(ctx context.Context, uris []string, chunkID int64) (map[string]int64, error)
-	LoadLocalBody(ctx context.Context, uri string, chunkID int64) ([]chunkline.BodyItem, error)
+	LoadLocalBody(ctx context.Context, uri string, chunkID int64) ([]chunkline.BodyItem, bool, error)
+	LookupLocalAscendingItrs(ctx context.Context, uris []string, chunkID int64) (map[string]int64, error)
+	LoadLocalAscendingBody(ctx context.Context, uri string, chunkID int64) ([]chunkline.BodyItem, bool, error)
+	GetRemovedItems(ctx context.Context, uri string) ([]string, error)
+	ListAllRemovedItems(ctx context.Context, uri string) ([]string, error)
+	ListTimelines(ctx context.Context, cursor int64, limit int) ([]string, int64, error)
+	ListLocalChunks(ctx context.Context, uri string) ([]int64, error)
 }
 
 // ChunklineGateway encapsulates external timeline resolution.
 type ChunklineGateway interface {
 	QueryDescending(ctx context.Context, uris []string, until time.Time, limit int) ([]chunkline.BodyItem, error)
+	QueryAscending(ctx context.Context, uris []string, since time.Time, limit int) ([]chunkline.BodyItem, error)
 }
 
 func NewChunklineUsecase(repo ChunklineRepository, gateway ChunklineGateway) *ChunklineUsecase {
@@ -32,7 +43,7 @@ func NewChunklineUsecase(repo ChunklineRepository, gateway ChunklineGateway) *Ch
 	}
 }
 
-func (uc *ChunklineUsecase) GetChunklineManifest(ctx context.Context, uri string) (*chunkline.Manifest, error) {
+func (uc *ChunklineUsecase) GetChunklineManifest(ctx context.Context, uri string) (*concrnt.ChunklineManifest, error) {
 	return uc.repo.GetChunklineManifest(ctx, uri)
 }
 
@@ -40,10 +51,40 @@ func (uc *ChunklineUsecase) LookupLocalItrs(ctx context.Context, uris []string,
 	return uc.repo.LookupLocalItrs(ctx, uris, chunkID)
 }
 
-func (uc *ChunklineUsecase) LoadLocalBody(ctx context.Context, uri string, chunkID int64) ([]chunkline.BodyItem, error) {
+// LoadLocalBody also reports whether the chunk is closed, i.e. can no longer gain items.
+func (uc *ChunklineUsecase) LoadLocalBody(ctx context.Context, uri string, chunkID int64) ([]chunkline.BodyItem, bool, error) {
 	return uc.repo.LoadLocalBody(ctx, uri, chunkID)
 }
 
+// LoadLocalBodies loads the bodies of many timelines, keyed by timeline URI. Unknown timelines are left out.
+func (uc *ChunklineUsecase) LoadLocalBodies(ctx context.Context, chunks map[string]int64) (map[string][]chunkline.BodyItem, error) {
+	result := make(map[string][]chunkline.BodyItem, len(chunks))
+	for uri, chunkID := range chunks {
+		items, _, err := uc.repo.LoadLocalBody(ctx, uri, chunkID)
+		if err != nil {
+			if errors.Is(err, domain.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		result[uri] = items
+	}
+	return result, nil
+}
+
+func (uc *ChunklineUsecase) LookupLocalAscendingItrs(ctx context.Context, uris []string, chunkID int64) (map[string]int64, error) {
+	return uc.repo.LookupLocalAscendingItrs(ctx, uris, chunkID)
+}
+
+// LoadLocalAscendingBody also reports whether the chunk is closed, i.e. can no longer gain items.
+func (uc *ChunklineUsecase) LoadLocalAscendingBody(ctx context.Context, uri string, chunkID int64) ([]chunkline.BodyItem, bool, error) {
+	return uc.repo.LoadLocalAscendingBody(ctx, uri, chunkID)
+}
+
+func (uc *ChunklineUsecase) GetRemovedItems(ctx context.Context, uri string) ([]string, error) {
+	return uc.repo.GetRemovedItems(ctx, uri)
+}
+
 func (uc *ChunklineUsecase) GetRecent(ctx context.Context, uris []string, until time.Time, limit int) ([]chunkline.BodyItem, error) {
 
 	if uc.gateway == nil {
@@ -57,3 +98,17 @@ func (uc *ChunklineUsecase) GetRecent(ctx context.Context, uris []string, until
 
 	return items, nil
 }
+
+func (uc *ChunklineUsecase) GetRange(ctx context.Context, uris []string, since time.Time, limit int) ([]chunkline.BodyItem, error) {
+
+	if uc.gateway == nil {
+		return nil, fmt.Errorf("chunkline gateway not configured")
+	}
+
+	items, err := uc.gateway.QueryAscending(ctx, uris, since, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ascending: %v", err)
+	}
+
+	return items, nil
+}
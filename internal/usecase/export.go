@@ -0,0 +1,415 @@
+package usecase
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/concrnt/chunkline"
+
+	"github.com/totegamma/concrnt-playground"
+	"github.com/totegamma/concrnt-playground/internal/domain"
+)
+
+const (
+	exportPageSize = 500
+	// exportDelay collects the events of a burst of commits, and lets their transactions finish
+	exportDelay = 2 * time.Second
+	// exportInterval is how often timelines with items in open chunks are revisited
+	exportInterval = time.Minute
+)
+
+// ExportStore holds the files of a static export. Get returns domain.ErrNotFound for missing files.
+type ExportStore interface {
+	Put(ctx context.Context, path, contentType string, body []byte) error
+	Get(ctx context.Context, path string) ([]byte, error)
+	Delete(ctx context.Context, path string) error
+}
+
+// ExportUsecase keeps a copy of this server in the static layout described in domain/static.go.
+// Only closed chunks are exported, the manifest's LastChunk is the last of them.
+type ExportUsecase struct {
+	config    domain.Config
+	records   RecordRepository
+	chunkline ChunklineRepository
+	stores    []ExportStore
+
+	mu        sync.Mutex
+	resources map[string]bool
+	timelines map[string]bool
+	wake      chan struct{}
+}
+
+// NewExportUsecase exports to every store. The first one is read back for incremental updates.
+func NewExportUsecase(config domain.Config, records RecordRepository, chunkline ChunklineRepository, stores ...ExportStore) *ExportUsecase {
+	return &ExportUsecase{
+		config:    config,
+		records:   records,
+		chunkline: chunkline,
+		stores:    stores,
+		resources: make(map[string]bool),
+		timelines: make(map[string]bool),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// OnPublish queues the resource of a signal channel and the timelines it belongs to for export.
+// It is meant to be registered with SignalService.OnPublish, whose hooks only see commits to this
+// server: events relayed from remote servers go through PublishRelayed, so remote records are
+// never queued, and their missing documents are never taken for deletions.
+func (uc *ExportUsecase) OnPublish(ctx context.Context, channel string, event concrnt.Event) {
+	uc.mu.Lock()
+	uc.resources[channel] = true
+	uc.timelines[channel] = true
+	parent, err := url.JoinPath(channel, "..")
+	if err == nil {
+		uc.timelines[parent] = true
+	}
+	uc.mu.Unlock()
+
+	select {
+	case uc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start exports queued changes until ctx is done.
+func (uc *ExportUsecase) Start(ctx context.Context) {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-uc.wake:
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(exportDelay):
+			}
+		}
+		uc.flush(ctx)
+	}
+}
+
+// Bootstrap exports everything unless the store already holds an export.
+func (uc *ExportUsecase) Bootstrap(ctx context.Context) {
+	_, err := uc.stores[0].Get(ctx, domain.StaticWellKnownPath)
+	if err == nil {
+		return
+	}
+	if !errors.Is(err, domain.ErrNotFound) {
+		slog.ErrorContext(
+			ctx, "Failed to read export",
+			slog.String("error", err.Error()),
+			slog.String("module", "export"),
+		)
+		return
+	}
+
+	err = uc.ExportAll(ctx)
+	if err != nil {
+		slog.ErrorContext(
+			ctx, "Failed to export",
+			slog.String("error", err.Error()),
+			slog.String("module", "export"),
+		)
+	}
+}
+
+// ExportAll exports every record and timeline. The well-known document goes last,
+// so that an interrupted export is redone by Bootstrap.
+func (uc *ExportUsecase) ExportAll(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "Usecase.Export.ExportAll")
+	defer span.End()
+
+	cursor := int64(0)
+	for {
+		uris, next, err := uc.records.ListURIs(ctx, cursor, exportPageSize)
+		if err != nil {
+			span.RecordError(err)
+			return err
+		}
+		for _, uri := range uris {
+			err = uc.exportResource(ctx, uri)
+			if err != nil {
+				span.RecordError(err)
+				return err
+			}
+		}
+		if len(uris) < exportPageSize {
+			break
+		}
+		cursor = next
+	}
+
+	cursor = 0
+	for {
+		uris, next, err := uc.chunkline.ListTimelines(ctx, cursor, exportPageSize)
+		if err != nil {
+			span.RecordError(err)
+			return err
+		}
+		for _, uri := range uris {
+			done, err := uc.exportTimeline(ctx, uri)
+			if err != nil {
+				span.RecordError(err)
+				return err
+			}
+			if !done {
+				uc.mu.Lock()
+				uc.timelines[uri] = true
+				uc.mu.Unlock()
+			}
+		}
+		if len(uris) < exportPageSize {
+			break
+		}
+		cursor = next
+	}
+
+	return uc.exportWellKnown(ctx)
+}
+
+// flush exports the queued resources and timelines. Timelines which failed or still
+// have items in open chunks stay queued.
+func (uc *ExportUsecase) flush(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "Usecase.Export.flush")
+	defer span.End()
+
+	uc.mu.Lock()
+	resources := uc.resources
+	timelines := uc.timelines
+	uc.resources = make(map[string]bool)
+	uc.timelines = make(map[string]bool)
+	uc.mu.Unlock()
+
+	for uri := range resources {
+		err := uc.exportResource(ctx, uri)
+		if err != nil {
+			span.RecordError(err)
+			slog.ErrorContext(
+				ctx, "Failed to export resource",
+				slog.String("uri", uri),
+				slog.String("error", err.Error()),
+				slog.String("module", "export"),
+			)
+			uc.mu.Lock()
+			uc.resources[uri] = true
+			uc.mu.Unlock()
+		}
+	}
+
+	for uri := range timelines {
+		done, err := uc.exportTimeline(ctx, uri)
+		if err != nil {
+			span.RecordError(err)
+			slog.ErrorContext(
+				ctx, "Failed to export timeline",
+				slog.String("uri", uri),
+				slog.String("error", err.Error()),
+				slog.String("module", "export"),
+			)
+		}
+		if err != nil || !done {
+			uc.mu.Lock()
+			uc.timelines[uri] = true
+			uc.mu.Unlock()
+		}
+	}
+}
+
+func (uc *ExportUsecase) put(ctx context.Context, path, contentType string, body []byte) error {
+	for _, store := range uc.stores {
+		err := store.Put(ctx, path, contentType, body)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (uc *ExportUsecase) putJSON(ctx context.Context, path string, value any) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return uc.put(ctx, path, "application/json", body)
+}
+
+func (uc *ExportUsecase) delete(ctx context.Context, path string) error {
+	for _, store := range uc.stores {
+		err := store.Delete(ctx, path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (uc *ExportUsecase) exportWellKnown(ctx context.Context) error {
+	return uc.putJSON(ctx, domain.StaticWellKnownPath, StaticWellKnown(uc.config))
+}
+
+// StaticWellKnown is the well-known document of a server in the static layout.
+func StaticWellKnown(config domain.Config) concrnt.WellKnownConcrnt {
+	return concrnt.WellKnownConcrnt{
+		Version: "2.0",
+		Domain:  config.FQDN,
+		CSID:    config.CSID,
+		Layer:   config.Layer,
+		Endpoints: map[string]concrnt.ConcrntEndpoint{
+			"net.concrnt.resource": {
+				Template: "/resource/{ccid}/{key}.json",
+				Method:   "GET",
+			},
+			"net.concrnt.chunkline.manifest": {
+				Template: "/chunkline/{ccid}/{key}/manifest.json",
+				Method:   "GET",
+			},
+		},
+	}
+}
+
+// exportResource writes the signed document of uri, or removes it when the record is gone.
+func (uc *ExportUsecase) exportResource(ctx context.Context, uri string) error {
+	owner, key, err := concrnt.ParseCCURI(uri)
+	if err != nil || key == "" {
+		return nil
+	}
+	path, err := domain.StaticResourcePath(owner, key)
+	if err != nil {
+		return nil
+	}
+
+	sd, err := uc.records.GetSignedDocument(ctx, uri)
+	if errors.Is(err, domain.ErrNotFound) {
+		return uc.delete(ctx, path)
+	}
+	if err != nil {
+		return err
+	}
+
+	return uc.putJSON(ctx, path, sd)
+}
+
+// exportTimeline writes the chunks of uri closed since the previous export, then its manifest.
+// It reports whether the newest item of the timeline is exported.
+func (uc *ExportUsecase) exportTimeline(ctx context.Context, uri string) (bool, error) {
+	ctx, span := tracer.Start(ctx, "Usecase.Export.exportTimeline")
+	defer span.End()
+
+	owner, key, err := concrnt.ParseCCURI(uri)
+	if err != nil || key == "" {
+		return true, nil
+	}
+	base, err := domain.StaticChunklinePath(owner, key)
+	if err != nil {
+		return true, nil
+	}
+
+	manifest, err := uc.chunkline.GetChunklineManifest(ctx, uri)
+	if errors.Is(err, domain.ErrNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		span.RecordError(err)
+		return false, err
+	}
+
+	// exported bodies of closed chunks are never rewritten, so every removal is listed
+	removed, err := uc.chunkline.ListAllRemovedItems(ctx, uri)
+	if err != nil {
+		span.RecordError(err)
+		return false, err
+	}
+
+	metadata, _ := manifest.Metadata.(concrnt.ChunklineMetadata)
+	if metadata.MemberCount == 0 && len(removed) == 0 {
+		// not a collection
+		return true, nil
+	}
+
+	chunks, err := uc.chunkline.ListLocalChunks(ctx, uri)
+	if err != nil {
+		span.RecordError(err)
+		return false, err
+	}
+
+	lastClosed := manifest.Time2Chunk(time.Now().Add(-domain.ChunkCloseGrace)) - 1
+	firstChunk := lastClosed + 1
+	if len(chunks) > 0 {
+		firstChunk = chunks[0]
+	}
+
+	from := firstChunk
+	var previous concrnt.ChunklineManifest
+	body, err := uc.stores[0].Get(ctx, base+"/manifest.json")
+	if err == nil && json.Unmarshal(body, &previous) == nil &&
+		previous.ChunkSize == manifest.ChunkSize && previous.FirstChunk == firstChunk {
+		from = max(from, previous.LastChunk+1)
+	}
+
+	for chunkID := from; chunkID <= lastClosed; chunkID++ {
+		// the newest chunk with items at or before chunkID
+		i := sort.Search(len(chunks), func(i int) bool { return chunks[i] > chunkID })
+		itr := int64(0)
+		if i > 0 {
+			itr = chunks[i-1]
+		}
+		err = uc.put(ctx, base+"/"+strconv.FormatInt(chunkID, 10)+".itr", "text/plain", []byte(strconv.FormatInt(itr, 10)))
+		if err != nil {
+			span.RecordError(err)
+			return false, err
+		}
+
+		if itr != chunkID {
+			continue
+		}
+		items, _, err := uc.chunkline.LoadLocalBody(ctx, uri, chunkID)
+		if err != nil {
+			span.RecordError(err)
+			return false, err
+		}
+		err = uc.putJSON(ctx, base+"/"+strconv.FormatInt(chunkID, 10)+".body.json", items)
+		if err != nil {
+			span.RecordError(err)
+			return false, err
+		}
+	}
+
+	err = uc.putJSON(ctx, base+"/removed.json", removed)
+	if err != nil {
+		span.RecordError(err)
+		return false, err
+	}
+
+	err = uc.putJSON(ctx, base+"/manifest.json", concrnt.ChunklineManifest{
+		Manifest: chunkline.Manifest{
+			Version:    manifest.Version,
+			ChunkSize:  manifest.ChunkSize,
+			FirstChunk: firstChunk,
+			LastChunk:  lastClosed,
+			Descending: &chunkline.Endpoint{
+				Iterator: base + "/{chunk}.itr",
+				Body:     base + "/{chunk}.body.json",
+			},
+			Metadata: manifest.Metadata,
+		},
+		Removed: base + "/removed.json",
+	})
+	if err != nil {
+		span.RecordError(err)
+		return false, err
+	}
+
+	return len(chunks) == 0 || chunks[len(chunks)-1] <= lastClosed, nil
+}
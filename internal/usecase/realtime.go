@@ -0,0 +1,167 @@
+package usecase
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+
+	"github.com/totegamma/concrnt-playground"
+	"github.com/totegamma/concrnt-playground/internal/domain"
+	"github.com/totegamma/concrnt-playground/policy"
+)
+
+const policyActionRead = "read"
+
+// PolicyEvaluator evaluates CIP-8 policies attached to documents.
+type PolicyEvaluator interface {
+	Evaluate(ctx context.Context, policies []concrnt.Policy, rctx policy.RequestContext, action string) (bool, error)
+}
+
+type RealtimeUsecase struct {
+	repo   RecordRepository
+	policy PolicyEvaluator
+	cache  *cache.Cache
+}
+
+func NewRealtimeUsecase(repo RecordRepository, policy PolicyEvaluator) *RealtimeUsecase {
+	return &RealtimeUsecase{
+		repo:   repo,
+		policy: policy,
+		cache:  cache.New(time.Minute, 5*time.Minute),
+	}
+}
+
+type collectionInfo struct {
+	owner    string
+	document map[string]any
+	policies []concrnt.Policy
+}
+
+// FilterEvent returns the event as the requester is allowed to see it.
+// If the read policy of the event's collection (or of the document itself)
+// does not allow the requester, only the event type and URI are delivered.
+func (uc *RealtimeUsecase) FilterEvent(ctx context.Context, requester string, event concrnt.Event) concrnt.Event {
+	ctx, span := tracer.Start(ctx, "Usecase.Realtime.FilterEvent")
+	defer span.End()
+
+	if event.SD == nil {
+		return event
+	}
+
+	allowed, err := uc.canRead(ctx, requester, event)
+	if err != nil {
+		span.RecordError(err)
+	}
+	if err != nil || !allowed {
+		return concrnt.Event{
+			ID:   event.ID,
+			Type: event.Type,
+			URI:  event.URI,
+		}
+	}
+
+	return event
+}
+
+func (uc *RealtimeUsecase) canRead(ctx context.Context, requester string, event concrnt.Event) (bool, error) {
+
+	var doc concrnt.Document[any]
+	err := json.Unmarshal([]byte(event.SD.Document), &doc)
+	if err != nil {
+		return false, err
+	}
+
+	if requester != "" && (requester == doc.Author || (doc.Owner != nil && *doc.Owner == requester)) {
+		return true, nil
+	}
+
+	collection, err := uc.getCollection(ctx, event.URI)
+	if err != nil {
+		return false, err
+	}
+
+	var policies []concrnt.Policy
+	var parent any
+	if collection != nil {
+		if requester != "" && requester == collection.owner {
+			return true, nil
+		}
+		policies = append(policies, collection.policies...)
+		parent = collection.document
+	}
+	if doc.Policies != nil {
+		policies = append(policies, *doc.Policies...)
+	}
+
+	if len(policies) == 0 {
+		return true, nil
+	}
+
+	var this map[string]any
+	err = json.Unmarshal([]byte(event.SD.Document), &this)
+	if err != nil {
+		return false, err
+	}
+
+	var requesterInfo any
+	if requester != "" {
+		requesterInfo = map[string]any{"ccid": requester}
+	}
+
+	rctx := policy.RequestContext{
+		Requester: requesterInfo,
+		Parent:    parent,
+		This:      this,
+	}
+
+	return uc.policy.Evaluate(ctx, policies, rctx, policyActionRead)
+}
+
+// getCollection loads the collection containing uri. It returns nil if uri is not inside a collection document.
+func (uc *RealtimeUsecase) getCollection(ctx context.Context, uri string) (*collectionInfo, error) {
+
+	owner, key, err := concrnt.ParseCCURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	parentKey := path.Dir(key)
+	if parentKey == "." || parentKey == "/" {
+		return nil, nil
+	}
+	collectionURI := concrnt.ComposeCCURI(owner, parentKey)
+
+	if cached, found := uc.cache.Get(collectionURI); found {
+		return cached.(*collectionInfo), nil
+	}
+
+	doc, err := uc.repo.GetDocument(ctx, collectionURI)
+	if err != nil {
+		if errors.Is(err, domain.ErrNotFound) {
+			uc.cache.Set(collectionURI, (*collectionInfo)(nil), cache.DefaultExpiration)
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	info := &collectionInfo{owner: owner}
+	if doc.Policies != nil {
+		info.policies = *doc.Policies
+	}
+
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(raw, &info.document)
+	if err != nil {
+		return nil, err
+	}
+
+	uc.cache.Set(collectionURI, info, cache.DefaultExpiration)
+	return info, nil
+}
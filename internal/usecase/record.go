@@ -10,7 +10,9 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/totegamma/concrnt-playground"
+	"github.com/totegamma/concrnt-playground/internal/domain"
 	"github.com/totegamma/concrnt-playground/internal/utils"
+	"github.com/totegamma/concrnt-playground/policy"
 	"github.com/totegamma/concrnt-playground/schemas"
 )
 
@@ -18,24 +20,39 @@ import (
 type RecordRepository interface {
 	CreateRecord(ctx context.Context, sd concrnt.SignedDocument) error
 	CreateAssociation(ctx context.Context, sd concrnt.SignedDocument) error
+	CreateRemoteAssociation(ctx context.Context, sd concrnt.SignedDocument) error
 	CreateAck(ctx context.Context, sd concrnt.SignedDocument) error
 	Delete(ctx context.Context, sd concrnt.SignedDocument) error
 
 	GetDocument(ctx context.Context, uri string) (*concrnt.Document[any], error)
 	GetSignedDocument(ctx context.Context, uri string) (*concrnt.SignedDocument, error)
+	GetSignedDocuments(ctx context.Context, uris []string) (map[string]concrnt.SignedDocument, error)
+	GetAssociationTarget(ctx context.Context, uri string) (string, error)
 
-	GetAssociatedRecords(ctx context.Context, targetURI, schema, variant, author string) ([]concrnt.Document[any], error)
+	GetAssociatedRecords(ctx context.Context, targetURI, schema, variant, author string, cursor *domain.QueryCursor, limit int, order string) ([]concrnt.SignedDocument, *domain.QueryCursor, error)
 	GetAssociatedRecordCountsBySchema(ctx context.Context, targetURI string) (map[string]int64, error)
 	GetAssociatedRecordCountsByVariant(ctx context.Context, targetURI, schema string) (*utils.OrderedKVMap[int64], error)
-	Query(ctx context.Context, prefix, schema string, since, until *time.Time, limit int, order string) (map[string]concrnt.Document[any], error)
+	Query(ctx context.Context, prefix, schema string, since, until *time.Time, filter *policy.Expr, cursor *domain.QueryCursor, limit int, order string) ([]concrnt.QueryItem, *domain.QueryCursor, error)
+	ListURIs(ctx context.Context, cursor int64, limit int) ([]string, int64, error)
+	ListChildren(ctx context.Context, uri string, depth int, cursor string, limit int) (*concrnt.ChildrenResult, error)
+}
+
+// RecordGateway reaches records of other servers: it delivers associations to them and fetches their documents.
+type RecordGateway interface {
+	Home(ctx context.Context, uri string) (string, error)
+	IsLocal(domain string) bool
+	Deliver(ctx context.Context, domain string, sd concrnt.SignedDocument) error
+	FetchResources(ctx context.Context, uris []string) map[string]concrnt.ResourceBatchItem
 }
 
 type RecordUsecase struct {
-	repo RecordRepository
+	repo    RecordRepository
+	gateway RecordGateway
 }
 
-func NewRecordUsecase(repo RecordRepository) *RecordUsecase {
-	return &RecordUsecase{repo: repo}
+// NewRecordUsecase creates a record usecase. Without gateway every association target is taken as local.
+func NewRecordUsecase(repo RecordRepository, gateway RecordGateway) *RecordUsecase {
+	return &RecordUsecase{repo: repo, gateway: gateway}
 }
 
 func (uc *RecordUsecase) Commit(ctx context.Context, sd concrnt.SignedDocument) error {
@@ -77,6 +94,10 @@ func (uc *RecordUsecase) Commit(ctx context.Context, sd concrnt.SignedDocument)
 	switch doc.Schema {
 	// 特殊なスキーマの場合の処理
 	case schemas.DeleteURL:
+		if err := uc.deliverRemoval(ctx, doc, sd); err != nil {
+			span.RecordError(err)
+			return err
+		}
 		return uc.repo.Delete(ctx, sd)
 	default:
 		// Associateフィールドがあれば通常Recordではない
@@ -90,7 +111,7 @@ func (uc *RecordUsecase) Commit(ctx context.Context, sd concrnt.SignedDocument)
 			if path.Path == "" {
 				return uc.repo.CreateAck(ctx, sd)
 			} else {
-				return uc.repo.CreateAssociation(ctx, sd)
+				return uc.associate(ctx, *doc.Associate, sd)
 			}
 		} else {
 			return uc.repo.CreateRecord(ctx, sd)
@@ -98,6 +119,56 @@ func (uc *RecordUsecase) Commit(ctx context.Context, sd concrnt.SignedDocument)
 	}
 }
 
+// associate stores an association on target. Associations on records of other servers are delivered
+// to the target's server, which publishes and counts them, and kept here as the author's copy.
+func (uc *RecordUsecase) associate(ctx context.Context, target string, sd concrnt.SignedDocument) error {
+	if uc.gateway == nil {
+		return uc.repo.CreateAssociation(ctx, sd)
+	}
+
+	home, err := uc.gateway.Home(ctx, target)
+	if err != nil {
+		return err
+	}
+	if uc.gateway.IsLocal(home) {
+		return uc.repo.CreateAssociation(ctx, sd)
+	}
+
+	err = uc.gateway.Deliver(ctx, home, sd)
+	if err != nil {
+		return err
+	}
+	return uc.repo.CreateRemoteAssociation(ctx, sd)
+}
+
+// deliverRemoval delivers the removal of an association on a record of another server to that server.
+func (uc *RecordUsecase) deliverRemoval(ctx context.Context, doc concrnt.Document[any], sd concrnt.SignedDocument) error {
+	if uc.gateway == nil {
+		return nil
+	}
+	uri, ok := doc.Value.(string)
+	if !ok {
+		return nil
+	}
+
+	target, err := uc.repo.GetAssociationTarget(ctx, uri)
+	if errors.Is(err, domain.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	home, err := uc.gateway.Home(ctx, target)
+	if err != nil {
+		return err
+	}
+	if uc.gateway.IsLocal(home) {
+		return nil
+	}
+	return uc.gateway.Deliver(ctx, home, sd)
+}
+
 func (uc *RecordUsecase) Get(ctx context.Context, uri string) (*concrnt.Document[any], error) {
 	return uc.repo.GetDocument(ctx, uri)
 }
@@ -106,8 +177,51 @@ func (uc *RecordUsecase) GetSigned(ctx context.Context, uri string) (*concrnt.Si
 	return uc.repo.GetSignedDocument(ctx, uri)
 }
 
-func (uc *RecordUsecase) GetAssociatedRecords(ctx context.Context, targetURI, schema, variant, author string) ([]concrnt.Document[any], error) {
-	return uc.repo.GetAssociatedRecords(ctx, targetURI, schema, variant, author)
+// GetSignedBatch returns the signed documents at uris keyed by URI with an error for each missing one.
+// With remote, documents not stored here are fetched from the servers storing them.
+func (uc *RecordUsecase) GetSignedBatch(ctx context.Context, uris []string, remote bool) (map[string]concrnt.ResourceBatchItem, error) {
+	ctx, span := tracer.Start(ctx, "Usecase.Record.GetSignedBatch")
+	defer span.End()
+
+	documents, err := uc.repo.GetSignedDocuments(ctx, uris)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	results := make(map[string]concrnt.ResourceBatchItem, len(uris))
+	var missing []string
+	for _, uri := range uris {
+		if document, ok := documents[uri]; ok {
+			results[uri] = concrnt.ResourceBatchItem{Document: &document}
+		} else if _, _, err := concrnt.ParseCCURI(uri); err != nil {
+			results[uri] = concrnt.ResourceBatchItem{Error: "invalid uri"}
+		} else {
+			missing = append(missing, uri)
+		}
+	}
+
+	if remote && uc.gateway != nil && len(missing) > 0 {
+		for uri, item := range uc.gateway.FetchResources(ctx, missing) {
+			results[uri] = item
+		}
+		return results, nil
+	}
+
+	for _, uri := range missing {
+		results[uri] = concrnt.ResourceBatchItem{Error: "not found"}
+	}
+	return results, nil
+}
+
+func (uc *RecordUsecase) GetAssociatedRecords(
+	ctx context.Context,
+	targetURI, schema, variant, author string,
+	cursor *domain.QueryCursor,
+	limit int,
+	order string,
+) ([]concrnt.SignedDocument, *domain.QueryCursor, error) {
+	return uc.repo.GetAssociatedRecords(ctx, targetURI, schema, variant, author, cursor, limit, order)
 }
 
 func (uc *RecordUsecase) GetAssociatedRecordCountsBySchema(ctx context.Context, targetURI string) (map[string]int64, error) {
@@ -122,8 +236,14 @@ func (uc *RecordUsecase) Query(
 	ctx context.Context,
 	prefix, schema string,
 	since, until *time.Time,
+	filter *policy.Expr,
+	cursor *domain.QueryCursor,
 	limit int,
 	order string,
-) (map[string]concrnt.Document[any], error) {
-	return uc.repo.Query(ctx, prefix, schema, since, until, limit, order)
+) ([]concrnt.QueryItem, *domain.QueryCursor, error) {
+	return uc.repo.Query(ctx, prefix, schema, since, until, filter, cursor, limit, order)
+}
+
+func (uc *RecordUsecase) ListChildren(ctx context.Context, uri string, depth int, cursor string, limit int) (*concrnt.ChildrenResult, error) {
+	return uc.repo.ListChildren(ctx, uri, depth, cursor, limit)
 }
@@ -0,0 +1,30 @@
+package usecase
+
+import (
+	"context"
+
+	"github.com/totegamma/concrnt-playground"
+	"github.com/totegamma/concrnt-playground/internal/domain"
+)
+
+// SearchRepository defines full-text search over record values.
+type SearchRepository interface {
+	Search(ctx context.Context, q, prefix, schema string, cursor *domain.QueryCursor, limit int) ([]concrnt.QueryItem, *domain.QueryCursor, error)
+}
+
+type SearchUsecase struct {
+	repo SearchRepository
+}
+
+func NewSearchUsecase(repo SearchRepository) *SearchUsecase {
+	return &SearchUsecase{repo: repo}
+}
+
+func (uc *SearchUsecase) Search(
+	ctx context.Context,
+	q, prefix, schema string,
+	cursor *domain.QueryCursor,
+	limit int,
+) ([]concrnt.QueryItem, *domain.QueryCursor, error) {
+	return uc.repo.Search(ctx, q, prefix, schema, cursor, limit)
+}
@@ -24,7 +24,7 @@ func SummerizeConclusion(conclusions []Conclusion, defaultAllow bool) bool {
 
 func EvaluatePolicy(policydoc PolicyDocument, ctx RequestContext, action string) (Conclusion, error) {
 
-	policy, ok := policydoc.Versions["2024-01-01"]
+	policy, ok := policydoc.Versions[Version]
 	if !ok {
 		return UNSET, fmt.Errorf("unsupported policy version")
 	}
@@ -1,5 +1,8 @@
 package policy
 
+// Version is the policy document version understood by EvaluatePolicy.
+const Version = "2024-01-01"
+
 type Conclusion int
 
 const (
@@ -0,0 +1,8 @@
+package schemas
+
+// ChunklineOptions overrides the server's chunk layout for a collection.
+// It is read from the "chunkline" property of the collection document's value.
+type ChunklineOptions struct {
+	ChunkSize int64 `json:"chunkSize,omitempty"` // seconds
+	BodySize  int   `json:"bodySize,omitempty"`
+}
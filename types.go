@@ -2,6 +2,8 @@ package concrnt
 
 import (
 	"time"
+
+	"github.com/concrnt/chunkline"
 )
 
 const (
@@ -12,6 +14,7 @@ type ConcrntEndpoint struct {
 	Template string    `json:"template"`
 	Method   string    `json:"method"`
 	Query    *[]string `json:"query,omitempty"`
+	Version  string    `json:"version,omitempty"`
 }
 
 type SoftwareInfo struct {
@@ -87,7 +90,125 @@ type RegisterRequest[T any] struct {
 }
 
 type Event struct {
-	Type string          `json:"type"`
-	URI  string          `json:"uri"`
-	SD   *SignedDocument `json:"signedDocument"`
+	ID   string `json:"id,omitempty"`
+	Type string `json:"type"`
+	URI  string `json:"uri"`
+	// Channel is the channel the event was published on. It differs from URI for removals
+	// from a collection, which are published on the collection with the item as URI.
+	Channel string          `json:"channel,omitempty"`
+	SD      *SignedDocument `json:"signedDocument"`
+}
+
+type RealtimeRequest struct {
+	Type     string   `json:"type"`
+	ID       string   `json:"id,omitempty"`
+	Prefixes []string `json:"prefixes,omitempty"`
+	Since    string   `json:"since,omitempty"`
+}
+
+type RealtimeResponse struct {
+	Type  string `json:"type"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// QueryResult is a page of records in the requested order. Next is the cursor of the following page
+// and empty on the last one.
+type QueryResult struct {
+	Items []QueryItem `json:"items"`
+	Next  string      `json:"next,omitempty"`
+}
+
+type QueryItem struct {
+	URI      string        `json:"uri"`
+	Document Document[any] `json:"document"`
+}
+
+// ResourceWithCounts is a signed document with the number of its associations per schema.
+type ResourceWithCounts struct {
+	SignedDocument
+	AssociationCounts map[string]int64 `json:"associationCounts"`
+}
+
+// AssociationResult is a page of signed associations of a record in the requested order.
+// Next is the cursor of the following page and empty on the last one.
+type AssociationResult struct {
+	Items []SignedDocument `json:"items"`
+	Next  string           `json:"next,omitempty"`
+}
+
+// ChildrenResult lists the keys directly under URI in the record tree. Summary covers the whole subtree.
+// Next is the cursor of the following page of Children, if there is one.
+type ChildrenResult struct {
+	URI      string          `json:"uri"`
+	Children []ChildEntry    `json:"children"`
+	Summary  ChildrenSummary `json:"summary"`
+	Next     string          `json:"next,omitempty"`
+}
+
+// ChildEntry is a key in the record tree. Keys without a record are intermediate folders.
+// Children is only filled up to the requested depth and limit, ChildCount is always set.
+type ChildEntry struct {
+	URI        string       `json:"uri"`
+	Schema     string       `json:"schema,omitempty"`
+	HasRecord  bool         `json:"hasRecord"`
+	ChildCount int64        `json:"childCount"`
+	Children   []ChildEntry `json:"children,omitempty"`
+}
+
+// ChildrenSummary is the number of records under a key and the total size of their documents in bytes.
+type ChildrenSummary struct {
+	Records int64 `json:"records"`
+	Size    int64 `json:"size"`
+}
+
+// ChunklineManifest is a chunkline manifest with concrnt specific endpoints.
+type ChunklineManifest struct {
+	chunkline.Manifest
+	// Removed is the path of the IDs of items removed from the timeline.
+	Removed string `json:"removed,omitempty"`
+	// Batch serves descending iterators and bodies of many timelines of the same server at once.
+	Batch *ChunklineBatchEndpoint `json:"batch,omitempty"`
+}
+
+// ChunklineBatchEndpoint holds the paths of the batch endpoints. Both take a POST request.
+type ChunklineBatchEndpoint struct {
+	// Iterator takes a ChunklineItrBatchRequest and returns the chunk IDs keyed by timeline URI.
+	Iterator string `json:"iterator"`
+	// Body takes a ChunklineBodyBatchRequest and returns the body items keyed by timeline URI.
+	Body string `json:"body"`
+}
+
+// ChunklineMetadata describes the collection behind a timeline. It is carried as the manifest metadata
+// so that clients can render a timeline header without fetching the collection itself.
+type ChunklineMetadata struct {
+	Schema   string    `json:"schema,omitempty"`
+	Owner    string    `json:"owner,omitempty"`
+	Value    any       `json:"value,omitempty"`
+	Policies *[]Policy `json:"policies,omitempty"`
+
+	MemberCount int64      `json:"memberCount"`
+	LastUpdate  *time.Time `json:"lastUpdate,omitempty"`
+}
+
+// ResourceBatchRequest asks for the signed documents at URIs. With Remote, documents stored on other
+// servers are fetched from them.
+type ResourceBatchRequest struct {
+	URIs   []string `json:"uris"`
+	Remote bool     `json:"remote,omitempty"`
+}
+
+// ResourceBatchItem is the result for one URI of a batch request. Exactly one of Document and Error is set.
+type ResourceBatchItem struct {
+	Document *SignedDocument `json:"document,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+type ChunklineItrBatchRequest struct {
+	URIs  []string `json:"uris"`
+	Chunk int64    `json:"chunk"`
+}
+
+type ChunklineBodyBatchRequest struct {
+	Chunks map[string]int64 `json:"chunks"`
 }